@@ -0,0 +1,280 @@
+// Package bitmap implements a minimal roaring-style bitmap: doc IDs are
+// split into 65,536-wide chunks keyed by their high 16 bits, and each
+// chunk is stored as either a sorted array of low-16 values (cheap when
+// sparse) or a fixed-size bitmap (cheap when dense). It is used to encode
+// posting lists so query-time intersection doesn't require decoding a
+// full varint-delta stream.
+package bitmap
+
+import "sort"
+
+// arrayMaxCardinality is the chunk population above which we switch from
+// an ArrayContainer to a BitmapContainer.
+const arrayMaxCardinality = 4096
+
+// wordsPerChunk is the number of uint64 words needed to address all
+// 65,536 values in a chunk (65536 bits / 64 bits per word).
+const wordsPerChunk = 65536 / 64
+
+// ContainerType distinguishes how a chunk's bits are stored on disk.
+type ContainerType byte
+
+const (
+	ArrayContainer  ContainerType = 0
+	BitmapContainer ContainerType = 1
+)
+
+// Chunk holds the bits for one 65,536-wide band of doc IDs, identified by
+// Key (the doc ID's high 16 bits).
+type Chunk struct {
+	Key  uint16
+	Type ContainerType
+
+	// Array holds sorted low-16 values when Type == ArrayContainer.
+	Array []uint16
+
+	// Words holds a dense bitset when Type == BitmapContainer.
+	Words [wordsPerChunk]uint64
+}
+
+// Cardinality returns the number of set bits in the chunk.
+func (c *Chunk) Cardinality() int {
+	if c.Type == ArrayContainer {
+		return len(c.Array)
+	}
+	n := 0
+	for _, w := range c.Words {
+		n += popcount(w)
+	}
+	return n
+}
+
+func (c *Chunk) has(low uint16) bool {
+	if c.Type == ArrayContainer {
+		i := sort.Search(len(c.Array), func(i int) bool { return c.Array[i] >= low })
+		return i < len(c.Array) && c.Array[i] == low
+	}
+	return c.Words[low/64]&(1<<(low%64)) != 0
+}
+
+func (c *Chunk) toBitmap() {
+	if c.Type == BitmapContainer {
+		return
+	}
+	var words [wordsPerChunk]uint64
+	for _, v := range c.Array {
+		words[v/64] |= 1 << (v % 64)
+	}
+	c.Words = words
+	c.Array = nil
+	c.Type = BitmapContainer
+}
+
+// Values returns the chunk's members in ascending order, regardless of
+// which container type backs it.
+func (c *Chunk) Values() []uint16 {
+	return c.sortedLowValues()
+}
+
+// sortedLowValues returns the chunk's members in ascending order,
+// regardless of which container type backs it.
+func (c *Chunk) sortedLowValues() []uint16 {
+	if c.Type == ArrayContainer {
+		return c.Array
+	}
+	out := make([]uint16, 0, c.Cardinality())
+	for i, w := range c.Words {
+		for w != 0 {
+			b := trailingZeros(w)
+			out = append(out, uint16(i*64+b))
+			w &= w - 1
+		}
+	}
+	return out
+}
+
+// Bitmap is a sequence of chunks sorted by Key.
+type Bitmap struct {
+	Chunks []Chunk
+}
+
+// FromSortedDocIDs builds a Bitmap from doc IDs already sorted ascending,
+// choosing ArrayContainer or BitmapContainer per chunk based on
+// arrayMaxCardinality.
+func FromSortedDocIDs(ids []uint32) *Bitmap {
+	b := &Bitmap{}
+	i := 0
+	for i < len(ids) {
+		key := uint16(ids[i] >> 16)
+		j := i
+		var lows []uint16
+		for j < len(ids) && uint16(ids[j]>>16) == key {
+			lows = append(lows, uint16(ids[j]))
+			j++
+		}
+		c := Chunk{Key: key}
+		if len(lows) <= arrayMaxCardinality {
+			c.Type = ArrayContainer
+			c.Array = lows
+		} else {
+			c.Type = ArrayContainer
+			c.Array = lows
+			c.toBitmap()
+		}
+		b.Chunks = append(b.Chunks, c)
+		i = j
+	}
+	return b
+}
+
+// chunkByKey returns the chunk with the given key, or nil.
+func (b *Bitmap) chunkByKey(key uint16) *Chunk {
+	i := sort.Search(len(b.Chunks), func(i int) bool { return b.Chunks[i].Key >= key })
+	if i < len(b.Chunks) && b.Chunks[i].Key == key {
+		return &b.Chunks[i]
+	}
+	return nil
+}
+
+// And returns the intersection of a and b.
+func And(a, b *Bitmap) *Bitmap {
+	out := &Bitmap{}
+	i, j := 0, 0
+	for i < len(a.Chunks) && j < len(b.Chunks) {
+		ca, cb := &a.Chunks[i], &b.Chunks[j]
+		switch {
+		case ca.Key < cb.Key:
+			i++
+		case ca.Key > cb.Key:
+			j++
+		default:
+			if rc := intersectChunk(ca, cb); rc.Cardinality() > 0 {
+				out.Chunks = append(out.Chunks, rc)
+			}
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// AndNot returns the members of a that are not present in b.
+func AndNot(a, b *Bitmap) *Bitmap {
+	out := &Bitmap{}
+	for i := range a.Chunks {
+		ca := &a.Chunks[i]
+		cb := b.chunkByKey(ca.Key)
+		if cb == nil {
+			out.Chunks = append(out.Chunks, *ca)
+			continue
+		}
+		var kept []uint16
+		for _, v := range ca.sortedLowValues() {
+			if !cb.has(v) {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) > 0 {
+			out.Chunks = append(out.Chunks, Chunk{Key: ca.Key, Type: ArrayContainer, Array: kept})
+		}
+	}
+	return out
+}
+
+func intersectChunk(a, b *Chunk) Chunk {
+	rc := Chunk{Key: a.Key, Type: ArrayContainer}
+	av, bv := a.sortedLowValues(), b.sortedLowValues()
+	i, j := 0, 0
+	for i < len(av) && j < len(bv) {
+		switch {
+		case av[i] < bv[j]:
+			i++
+		case av[i] > bv[j]:
+			j++
+		default:
+			rc.Array = append(rc.Array, av[i])
+			i++
+			j++
+		}
+	}
+	return rc
+}
+
+// Iterator walks a Bitmap's doc IDs in ascending order and supports
+// skipping ahead without decoding earlier chunks.
+type Iterator struct {
+	b         *Bitmap
+	chunkIdx  int
+	lowValues []uint16
+	lowIdx    int
+}
+
+// NewIterator returns an Iterator positioned before the first doc ID.
+func NewIterator(b *Bitmap) *Iterator {
+	it := &Iterator{b: b}
+	it.loadChunk(0)
+	return it
+}
+
+func (it *Iterator) loadChunk(idx int) {
+	it.chunkIdx = idx
+	it.lowIdx = 0
+	if idx < len(it.b.Chunks) {
+		it.lowValues = it.b.Chunks[idx].sortedLowValues()
+	} else {
+		it.lowValues = nil
+	}
+}
+
+// Next returns the next doc ID and true, or (0, false) when exhausted.
+func (it *Iterator) Next() (uint32, bool) {
+	for it.chunkIdx < len(it.b.Chunks) {
+		if it.lowIdx < len(it.lowValues) {
+			key := it.b.Chunks[it.chunkIdx].Key
+			v := uint32(key)<<16 | uint32(it.lowValues[it.lowIdx])
+			it.lowIdx++
+			return v, true
+		}
+		it.loadChunk(it.chunkIdx + 1)
+	}
+	return 0, false
+}
+
+// Advance moves the iterator to the first doc ID >= target without
+// decoding chunks strictly before target's chunk, returning that doc ID
+// and true, or (0, false) if no such doc ID exists.
+func (it *Iterator) Advance(target uint32) (uint32, bool) {
+	key := uint16(target >> 16)
+	chunks := it.b.Chunks
+	if it.chunkIdx < len(chunks) && chunks[it.chunkIdx].Key < key {
+		rest := chunks[it.chunkIdx:]
+		it.loadChunk(it.chunkIdx + sort.Search(len(rest), func(i int) bool { return rest[i].Key >= key }))
+	}
+	if it.chunkIdx >= len(it.b.Chunks) {
+		return 0, false
+	}
+	if it.b.Chunks[it.chunkIdx].Key == key {
+		low := uint16(target)
+		i := sort.Search(len(it.lowValues), func(i int) bool { return it.lowValues[i] >= low })
+		it.lowIdx = i
+	}
+	return it.Next()
+}
+
+func popcount(w uint64) int {
+	n := 0
+	for w != 0 {
+		w &= w - 1
+		n++
+	}
+	return n
+}
+
+func trailingZeros(w uint64) int {
+	n := 0
+	for w&1 == 0 {
+		w >>= 1
+		n++
+	}
+	return n
+}
@@ -0,0 +1,99 @@
+package bitmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFromSortedDocIDsRoundTrip(t *testing.T) {
+	ids := []uint32{1, 2, 70000, 70001, 1 << 20}
+	bm := FromSortedDocIDs(ids)
+
+	var got []uint32
+	it := NewIterator(bm)
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, id)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Fatalf("round trip: got %v, want %v", got, ids)
+	}
+}
+
+func TestFromSortedDocIDsBitmapContainer(t *testing.T) {
+	ids := make([]uint32, 0, arrayMaxCardinality+1)
+	for i := uint32(0); i <= arrayMaxCardinality; i++ {
+		ids = append(ids, i)
+	}
+	bm := FromSortedDocIDs(ids)
+	if bm.Chunks[0].Type != BitmapContainer {
+		t.Fatalf("expected a BitmapContainer once cardinality exceeds %d, got %v", arrayMaxCardinality, bm.Chunks[0].Type)
+	}
+
+	var got []uint32
+	it := NewIterator(bm)
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, id)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Fatalf("round trip through BitmapContainer: got %d ids, want %d", len(got), len(ids))
+	}
+}
+
+func TestAndAndNot(t *testing.T) {
+	a := FromSortedDocIDs([]uint32{1, 2, 3, 70000})
+	b := FromSortedDocIDs([]uint32{2, 3, 4, 70000})
+
+	and := And(a, b)
+	var gotAnd []uint32
+	it := NewIterator(and)
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		gotAnd = append(gotAnd, id)
+	}
+	if want := []uint32{2, 3, 70000}; !reflect.DeepEqual(gotAnd, want) {
+		t.Fatalf("And: got %v, want %v", gotAnd, want)
+	}
+
+	andNot := AndNot(a, b)
+	var gotAndNot []uint32
+	it = NewIterator(andNot)
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		gotAndNot = append(gotAndNot, id)
+	}
+	if want := []uint32{1}; !reflect.DeepEqual(gotAndNot, want) {
+		t.Fatalf("AndNot: got %v, want %v", gotAndNot, want)
+	}
+}
+
+func TestIteratorAdvance(t *testing.T) {
+	ids := []uint32{1, 5, 70000, 70005, 140000}
+	bm := FromSortedDocIDs(ids)
+
+	it := NewIterator(bm)
+	id, ok := it.Advance(70000)
+	if !ok || id != 70000 {
+		t.Fatalf("Advance(70000): got (%d, %v), want (70000, true)", id, ok)
+	}
+	id, ok = it.Advance(70001)
+	if !ok || id != 70005 {
+		t.Fatalf("Advance(70001): got (%d, %v), want (70005, true)", id, ok)
+	}
+	if _, ok := it.Advance(1 << 30); ok {
+		t.Fatalf("Advance past the last doc ID should report exhausted")
+	}
+}
@@ -0,0 +1,65 @@
+package chunk
+
+import "testing"
+
+func TestWriteDocShardsReadDocRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	boilerplate := "This article is about a notable topic. "
+	var long string
+	for i := 0; i < 700; i++ {
+		long += "filler text to push the chunker well past its max size. "
+	}
+	// The shared prefix is longer than chunk.MaxSize, so Split forces a
+	// boundary inside it at a fixed offset regardless of content —
+	// guaranteeing at least one chunk that's byte-identical between A
+	// and B and so can actually dedup. Both docs land in the same shard
+	// (ID % 4 == 1).
+	docA := Document{ID: 1, Title: "A", Content: boilerplate + long + "unique to A"}
+	docB := Document{ID: 5, Title: "B", Content: boilerplate + long + "unique to B"}
+
+	docShards := make([][]Document, 4)
+	docShards[docA.ID%4] = append(docShards[docA.ID%4], docA)
+	docShards[docB.ID%4] = append(docShards[docB.ID%4], docB)
+
+	before, after := WriteDocShards(dir, docShards)
+	if before <= after {
+		t.Fatalf("expected deduplication to shrink shared boilerplate: before=%d after=%d", before, after)
+	}
+
+	for _, doc := range []Document{docA, docB} {
+		title, content, found := ReadDoc(dir, doc.ID%4, doc.ID)
+		if !found {
+			t.Fatalf("ReadDoc(%d): not found", doc.ID)
+		}
+		if title != doc.Title || content != doc.Content {
+			t.Fatalf("ReadDoc(%d) = (%q, %q), want (%q, %q)", doc.ID, title, content, doc.Title, doc.Content)
+		}
+	}
+
+	ids, err := DocIDs(dir, docA.ID%4)
+	if err != nil {
+		t.Fatalf("DocIDs: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != docA.ID || ids[1] != docB.ID {
+		t.Fatalf("DocIDs(%d) = %v, want [%d %d]", docA.ID%4, ids, docA.ID, docB.ID)
+	}
+}
+
+func TestSplitBoundsChunkSize(t *testing.T) {
+	content := make([]byte, MaxSize*3)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	chunks := Split(content)
+	var total int
+	for _, c := range chunks {
+		if len(c) > MaxSize {
+			t.Fatalf("chunk of size %d exceeds MaxSize %d", len(c), MaxSize)
+		}
+		total += len(c)
+	}
+	if total != len(content) {
+		t.Fatalf("chunks cover %d bytes, want %d", total, len(content))
+	}
+}
@@ -1,13 +1,66 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+
+	"github.com/maxmcd/wikisearch/search"
+	"github.com/maxmcd/wikisearch/segment"
 )
 
+const indexBase = "public"
+
+// searcher is opened once at startup and unions the base index with
+// every segment under public/index/segments, so queries see documents
+// added or removed by -incremental runs made before the server started.
+// Segments are discovered only here; one built later is not searched
+// until the server restarts.
+var searcher *segment.Searcher
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	re := r.URL.Query().Get("re")
+	if q == "" && re == "" {
+		http.Error(w, "missing q or re parameter", http.StatusBadRequest)
+		return
+	}
+	k := 10
+	if ks := r.URL.Query().Get("k"); ks != "" {
+		if n, err := strconv.Atoi(ks); err == nil && n > 0 {
+			k = n
+		}
+	}
+
+	var hits []search.Hit
+	var err error
+	if re != "" {
+		hits, err = search.RegexSegments(searcher, re, k)
+	} else {
+		phrase := r.URL.Query().Get("phrase") == "1"
+		hits, err = search.SearchSegments(searcher, q, k, phrase)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hits)
+}
+
 func main() {
+	var err error
+	searcher, err = segment.Open(indexBase)
+	if err != nil {
+		log.Fatalf("opening index at %s: %v", indexBase, err)
+	}
+
 	fs := http.FileServer(http.Dir("wiki_index"))
+	http.HandleFunc("/search", searchHandler)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, ".gz") {
 			w.Header().Set("Content-Encoding", "gzip")
@@ -10,10 +10,16 @@ import (
 	"hash/fnv"
 	"io"
 	"os"
-	"regexp"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"unicode"
+
+	"github.com/maxmcd/wikisearch/chunk"
+	"github.com/maxmcd/wikisearch/segment"
+	"github.com/maxmcd/wikisearch/trigram"
+	"github.com/maxmcd/wikisearch/wikitext"
 )
 
 type Posting struct {
@@ -21,16 +27,48 @@ type Posting struct {
 	Positions []uint32
 }
 
+// Format identifies the on-disk posting list layout. Format 2 stores
+// postings as roaring-style doc-ID bitmaps with a skip table instead of
+// a flat varint-delta stream; see writePostingList.
+const Format = 2
+
 type Meta struct {
-	DocCount      int `json:"docCount"`
-	ShardCount    int `json:"shardCount"`
-	DocShardCount int `json:"docShardCount"`
+	DocCount      int     `json:"docCount"`
+	ShardCount    int     `json:"shardCount"`
+	DocShardCount int     `json:"docShardCount"`
+	Format        int     `json:"format"`
+	AvgDocLen     float64 `json:"avgDocLen"`
+
+	// Chunk* persist the content-defined chunker's parameters so a
+	// reader can check it agrees with how doc shards were split.
+	ChunkMinSize    int `json:"chunkMinSize"`
+	ChunkTargetSize int `json:"chunkTargetSize"`
+	ChunkMaxSize    int `json:"chunkMaxSize"`
+
+	// Generation is always 0 for the base index; incremental segments
+	// under index/segments/ carry higher generations so a segment.Searcher
+	// can tell which touch of a docID is newest. Segments records the
+	// segments built on top of this base so far.
+	Generation int              `json:"generation"`
+	Segments   []SegmentSummary `json:"segments,omitempty"`
+}
+
+// SegmentSummary is one incremental segment's entry in the base index's
+// meta.json, so tooling can see what's been built without opening every
+// segment's own meta.json.
+type SegmentSummary struct {
+	ID         int `json:"id"`
+	Generation int `json:"generation"`
+	DocCount   int `json:"docCount"`
 }
 
 type Doc struct {
 	ID      uint32
 	Title   string
 	Content string
+	// Length is the document's token count, used by search to compute
+	// BM25's length-normalization term.
+	Length uint32
 }
 
 type Page struct {
@@ -40,49 +78,8 @@ type Page struct {
 	Text  string `xml:"revision>text"`
 }
 
-var (
-	commentRe       = regexp.MustCompile(`(?s)<!--.*?-->`)
-	refRe           = regexp.MustCompile(`(?s)<ref[^>]*>.*?</ref>|<ref[^/]*/>`)
-	templateRe      = regexp.MustCompile(`(?s)\{\{[^{}]*\}\}`)
-	tableRowRe      = regexp.MustCompile(`(?m)^[^\S\n]*[|!].*$`)
-	orphanBraceRe   = regexp.MustCompile(`(?m)^\{\{[A-Za-z][^{}\n]*$`)
-	orphanBracketRe = regexp.MustCompile(`(?m)^[^\[\]]*\]\]$`)
-	fileRe          = regexp.MustCompile(`(?i)\[\[(File|Image):[^\n]*\]\]`)
-	categoryRe      = regexp.MustCompile(`(?i)\[\[Category:[^\]]*\]\]`)
-	extLinkRe       = regexp.MustCompile(`\[https?://[^\]]*\]`)
-	thumbLineRe     = regexp.MustCompile(`(?im)^(thumb|thumbnail|right|left|center|\d+px)[|].*$`)
-	linkRe          = regexp.MustCompile(`\[\[(?:[^|\]]*\|)?([^\]]*)\]\]`)
-	tagRe           = regexp.MustCompile(`<[^>]+>`)
-	styleRe         = regexp.MustCompile(`'{2,}`)
-	headerRe        = regexp.MustCompile(`={2,}\s*([^=]+?)\s*={2,}`)
-	multiSpaceRe    = regexp.MustCompile(`[ \t]{2,}`)
-	multiNewlineRe  = regexp.MustCompile(`\n{3,}`)
-)
-
 func stripWikitext(s string) string {
-	s = commentRe.ReplaceAllString(s, "")
-	s = refRe.ReplaceAllString(s, "")
-	for i := 0; i < 10; i++ {
-		prev := s
-		s = templateRe.ReplaceAllString(s, "")
-		if s == prev {
-			break
-		}
-	}
-	s = tableRowRe.ReplaceAllString(s, "")
-	s = orphanBraceRe.ReplaceAllString(s, "")
-	s = orphanBracketRe.ReplaceAllString(s, "")
-	s = fileRe.ReplaceAllString(s, "")
-	s = categoryRe.ReplaceAllString(s, "")
-	s = extLinkRe.ReplaceAllString(s, "")
-	s = thumbLineRe.ReplaceAllString(s, "")
-	s = linkRe.ReplaceAllString(s, "$1")
-	s = tagRe.ReplaceAllString(s, "")
-	s = styleRe.ReplaceAllString(s, "")
-	s = headerRe.ReplaceAllString(s, "\n$1\n")
-	s = multiSpaceRe.ReplaceAllString(s, " ")
-	s = multiNewlineRe.ReplaceAllString(s, "\n\n")
-	return strings.TrimSpace(s)
+	return wikitext.Render(wikitext.Tokenize(s))
 }
 
 func tokenize(s string) []string {
@@ -117,34 +114,185 @@ func writeVarint(w io.Writer, v uint32) {
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("usage: wiki <dump.xml.bz2>")
+		fmt.Println("       wiki -incremental <changes.xml.bz2>")
+		fmt.Println("       wiki -compact <segment-dir>...")
 		os.Exit(1)
 	}
-	buildIndex(os.Args[1])
+	switch os.Args[1] {
+	case "-incremental":
+		if len(os.Args) < 3 {
+			fmt.Println("usage: wiki -incremental <changes.xml.bz2>")
+			os.Exit(1)
+		}
+		buildSegment(os.Args[2])
+	case "-compact":
+		if len(os.Args) < 4 {
+			fmt.Println("usage: wiki -compact <segment-dir>...")
+			os.Exit(1)
+		}
+		compactSegments(os.Args[2:])
+	default:
+		buildIndex(os.Args[1])
+	}
+}
+
+// buildSegment indexes a change stream into a new segment under
+// public/index/segments, then records it in the base index's meta.json
+// so a segment.Searcher picks it up.
+func buildSegment(changesPath string) {
+	meta, err := readBaseMeta()
+	if err != nil {
+		fmt.Println("error reading base index meta:", err)
+		os.Exit(1)
+	}
+
+	pages, err := segment.ReadChangeStream(changesPath)
+	if err != nil {
+		fmt.Println("error reading change stream:", err)
+		os.Exit(1)
+	}
+
+	id := len(meta.Segments)
+	generation := 1
+	if n := len(meta.Segments); n > 0 {
+		generation = meta.Segments[n-1].Generation + 1
+	}
+	segDir := fmt.Sprintf("public/index/segments/%05d", id)
+
+	fmt.Printf("building segment %d (generation %d) from %d changed pages...\n", id, generation, len(pages))
+	segMeta, err := segment.Build(segDir, id, generation, pages)
+	if err != nil {
+		fmt.Println("error building segment:", err)
+		os.Exit(1)
+	}
+
+	meta.Segments = append(meta.Segments, SegmentSummary{ID: segMeta.ID, Generation: segMeta.Generation, DocCount: segMeta.DocCount})
+	writeBaseMeta(meta)
+	fmt.Printf("done: segment %d has %d docs\n", id, segMeta.DocCount)
+}
+
+// compactSegments merges dirs (oldest generation first) into a new
+// segment appended after the newest recorded generation, then retires
+// whichever of dirs were themselves recorded segments: their entries
+// are dropped from the base index's meta.json and their directories are
+// deleted, so a later segment.Open doesn't still open them as extra
+// live roots and double-count their docs. The base index itself (it may
+// be among dirs, as the oldest generation) is never retired this way.
+func compactSegments(dirs []string) {
+	meta, err := readBaseMeta()
+	if err != nil {
+		fmt.Println("error reading base index meta:", err)
+		os.Exit(1)
+	}
+
+	id := len(meta.Segments)
+	generation := 1
+	if n := len(meta.Segments); n > 0 {
+		generation = meta.Segments[n-1].Generation + 1
+	}
+	outDir := fmt.Sprintf("public/index/segments/%05d", id)
+
+	fmt.Printf("compacting %d segments into segment %d (generation %d)...\n", len(dirs), id, generation)
+	segMeta, err := segment.Compact(outDir, id, generation, dirs)
+	if err != nil {
+		fmt.Println("error compacting segments:", err)
+		os.Exit(1)
+	}
+
+	retired := make(map[int]bool)
+	for _, d := range dirs {
+		if segID, ok := segmentDirID(d); ok {
+			retired[segID] = true
+		}
+	}
+	kept := meta.Segments[:0]
+	for _, seg := range meta.Segments {
+		if !retired[seg.ID] {
+			kept = append(kept, seg)
+		}
+	}
+	meta.Segments = kept
+
+	meta.Segments = append(meta.Segments, SegmentSummary{ID: segMeta.ID, Generation: segMeta.Generation, DocCount: segMeta.DocCount})
+	writeBaseMeta(meta)
+
+	for _, d := range dirs {
+		if _, ok := segmentDirID(d); ok {
+			os.RemoveAll(d)
+		}
+	}
+	fmt.Printf("done: compacted segment %d has %d docs, retired %d source segment(s)\n", id, segMeta.DocCount, len(retired))
+}
+
+// segmentDirID reports the segment ID embedded in dir's basename if dir
+// looks like a segment directory (public/index/segments/NNNNN); the
+// base index directory itself never matches, so compactSegments won't
+// mistake it for a segment to retire.
+func segmentDirID(dir string) (id int, ok bool) {
+	n, err := strconv.Atoi(filepath.Base(dir))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func readBaseMeta() (Meta, error) {
+	f, err := os.Open("public/index/meta.json")
+	if err != nil {
+		return Meta{}, err
+	}
+	defer f.Close()
+	var m Meta
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return Meta{}, err
+	}
+	return m, nil
+}
+
+func writeBaseMeta(m Meta) {
+	mf, _ := os.Create("public/index/meta.json")
+	json.NewEncoder(mf).Encode(m)
+	mf.Close()
 }
 
 const shardCount = 4096
 const docShardCount = 65536
 
-func writeDocShards(docShards [][]Doc) {
+func writeDocShards(docShards [][]Doc) (beforeBytes, afterBytes int64) {
+	chunkDocs := make([][]chunk.Document, len(docShards))
+	for shardNum, docs := range docShards {
+		for _, doc := range docs {
+			chunkDocs[shardNum] = append(chunkDocs[shardNum], chunk.Document{ID: doc.ID, Title: doc.Title, Content: doc.Content})
+		}
+	}
+	beforeBytes, afterBytes = chunk.WriteDocShards("public/docs", chunkDocs)
+
 	for shardNum, docs := range docShards {
 		if len(docs) == 0 {
 			continue
 		}
-		sf, _ := os.Create(fmt.Sprintf("public/docs/shard_%05d.bin", shardNum))
-		bw := bufio.NewWriter(sf)
-
-		binary.Write(bw, binary.LittleEndian, uint32(len(docs)))
+		// doclen files mirror docs_NNNNN.bin's doc order, so a reader that
+		// scans chunk.DocIDs can pair the i-th ID with the i-th varint
+		// here rather than storing the length inline.
+		lf, _ := os.Create(fmt.Sprintf("public/docs/doclen_%05d.bin", shardNum))
+		lbw := bufio.NewWriter(lf)
 		for _, doc := range docs {
-			binary.Write(bw, binary.LittleEndian, doc.ID)
-			binary.Write(bw, binary.LittleEndian, uint16(len(doc.Title)))
-			bw.WriteString(doc.Title)
-			binary.Write(bw, binary.LittleEndian, uint32(len(doc.Content)))
-			bw.WriteString(doc.Content)
+			writeVarint(lbw, doc.Length)
 		}
+		lbw.Flush()
+		lf.Close()
+	}
+	return beforeBytes, afterBytes
+}
 
-		bw.Flush()
-		sf.Close()
+func writeTrigramIndex(docShards [][]Doc) {
+	docs := make([]trigram.Document, 0, docShardCount)
+	for _, shard := range docShards {
+		for _, doc := range shard {
+			docs = append(docs, trigram.Document{ID: doc.ID, Title: doc.Title, Content: doc.Content})
+		}
 	}
+	trigram.Build("public/index/trigram", docs)
 }
 
 func buildIndex(dumpPath string) {
@@ -162,6 +310,7 @@ func buildIndex(dumpPath string) {
 	}
 	docShards := make([][]Doc, docShardCount)
 	docCount := 0
+	var totalDocLen uint64
 
 	decoder := xml.NewDecoder(bzip2.NewReader(f))
 	for {
@@ -180,10 +329,11 @@ func buildIndex(dumpPath string) {
 		}
 
 		text := stripWikitext(page.Text)
+		tokens := tokenize(text)
 		docShard := page.ID % docShardCount
-		docShards[docShard] = append(docShards[docShard], Doc{ID: page.ID, Title: page.Title, Content: text})
+		docShards[docShard] = append(docShards[docShard], Doc{ID: page.ID, Title: page.Title, Content: text, Length: uint32(len(tokens))})
+		totalDocLen += uint64(len(tokens))
 
-		tokens := tokenize(text)
 		positions := make(map[string][]uint32)
 		for i, t := range tokens {
 			positions[t] = append(positions[t], uint32(i))
@@ -200,7 +350,11 @@ func buildIndex(dumpPath string) {
 	}
 
 	fmt.Printf("total: %d docs, writing doc shards...\n", docCount)
-	writeDocShards(docShards)
+	beforeBytes, afterBytes := writeDocShards(docShards)
+	fmt.Printf("doc shard content: %d bytes -> %d bytes after chunk dedup\n", beforeBytes, afterBytes)
+
+	fmt.Printf("total: %d docs, writing trigram index...\n", docCount)
+	writeTrigramIndex(docShards)
 
 	fmt.Printf("total: %d docs, writing shards...\n", docCount)
 
@@ -218,27 +372,30 @@ func buildIndex(dumpPath string) {
 			postings := shard[t]
 			bw.WriteByte(byte(len(t)))
 			bw.WriteString(t)
-			binary.Write(bw, binary.LittleEndian, uint32(len(postings)))
 
 			sort.Slice(postings, func(a, b int) bool { return postings[a].DocID < postings[b].DocID })
-			var prevDoc uint32
-			for _, p := range postings {
-				writeVarint(bw, p.DocID-prevDoc)
-				prevDoc = p.DocID
-				writeVarint(bw, uint32(len(p.Positions)))
-				var prevPos uint32
-				for _, pos := range p.Positions {
-					writeVarint(bw, pos-prevPos)
-					prevPos = pos
-				}
-			}
+			writePostingList(bw, postings)
 		}
 		bw.Flush()
 		sf.Close()
 	}
 
+	var avgDocLen float64
+	if docCount > 0 {
+		avgDocLen = float64(totalDocLen) / float64(docCount)
+	}
+
 	mf, _ := os.Create("public/index/meta.json")
-	json.NewEncoder(mf).Encode(Meta{DocCount: docCount, ShardCount: shardCount, DocShardCount: docShardCount})
+	json.NewEncoder(mf).Encode(Meta{
+		DocCount:        docCount,
+		ShardCount:      shardCount,
+		DocShardCount:   docShardCount,
+		Format:          Format,
+		AvgDocLen:       avgDocLen,
+		ChunkMinSize:    chunk.MinSize,
+		ChunkTargetSize: chunk.TargetSize,
+		ChunkMaxSize:    chunk.MaxSize,
+	})
 	mf.Close()
 	fmt.Println("done")
 }
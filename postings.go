@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+
+	"github.com/maxmcd/wikisearch/bitmap"
+)
+
+// skipEntry is one row of a term's skip table, letting a reader jump
+// straight to a chunk's doc and position bytes without decoding earlier
+// chunks.
+type skipEntry struct {
+	ChunkKey           uint16
+	ByteOffsetDoc      uint32
+	ByteOffsetPos      uint32
+	CumulativeDocCount uint32
+}
+
+// writePostingList encodes one term's postings as a roaring-style doc-ID
+// bitmap, a parallel positions stream, and a skip table, and appends all
+// three to bw. postings must already be sorted by DocID ascending.
+func writePostingList(bw *bufio.Writer, postings []Posting) {
+	ids := make([]uint32, len(postings))
+	for i, p := range postings {
+		ids[i] = p.DocID
+	}
+	bm := bitmap.FromSortedDocIDs(ids)
+
+	var docBuf, posBuf []byte
+	skip := make([]skipEntry, 0, len(bm.Chunks))
+	docIdx := 0
+	var cumulative uint32
+
+	for i := range bm.Chunks {
+		chunk := &bm.Chunks[i]
+		values := chunk.Values()
+
+		skip = append(skip, skipEntry{
+			ChunkKey:           chunk.Key,
+			ByteOffsetDoc:      uint32(len(docBuf)),
+			ByteOffsetPos:      uint32(len(posBuf)),
+			CumulativeDocCount: cumulative,
+		})
+
+		docBuf = appendUint16(docBuf, chunk.Key)
+		docBuf = appendUvarint(docBuf, uint32(chunk.Cardinality()))
+		docBuf = append(docBuf, byte(chunk.Type))
+		if chunk.Type == bitmap.ArrayContainer {
+			for _, v := range values {
+				docBuf = appendUint16(docBuf, v)
+			}
+		} else {
+			for _, w := range chunk.Words {
+				docBuf = appendUint64(docBuf, w)
+			}
+		}
+
+		for range values {
+			p := postings[docIdx]
+			docIdx++
+			posBuf = appendUvarint(posBuf, uint32(len(p.Positions)))
+			var prevPos uint32
+			for _, pos := range p.Positions {
+				posBuf = appendUvarint(posBuf, pos-prevPos)
+				prevPos = pos
+			}
+		}
+		cumulative += uint32(chunk.Cardinality())
+	}
+
+	writeVarint(bw, uint32(len(skip)))
+	for _, e := range skip {
+		binary.Write(bw, binary.LittleEndian, e.ChunkKey)
+		writeVarint(bw, e.ByteOffsetDoc)
+		writeVarint(bw, e.ByteOffsetPos)
+		writeVarint(bw, e.CumulativeDocCount)
+	}
+	writeVarint(bw, uint32(len(docBuf)))
+	bw.Write(docBuf)
+	writeVarint(bw, uint32(len(posBuf)))
+	bw.Write(posBuf)
+}
+
+func appendUvarint(buf []byte, v uint32) []byte {
+	var tmp [5]byte
+	n := binary.PutUvarint(tmp[:], uint64(v))
+	return append(buf, tmp[:n]...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
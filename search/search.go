@@ -0,0 +1,333 @@
+// Package search answers ranked queries against a segment.Searcher's
+// union of the base index and its incremental segments: it tokenizes
+// the query, scores candidates with Okapi BM25, and builds a
+// highlighted snippet from the matching document's content.
+package search
+
+import (
+	"math"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/maxmcd/wikisearch/segment"
+)
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Hit is one ranked result.
+type Hit struct {
+	DocID   uint32
+	Title   string
+	Score   float64
+	Snippet string
+}
+
+// regexSnippet pads loc (a byte range into content found by
+// RegexSegments) out to a short window and wraps the match in <mark>,
+// mirroring bestSnippet.
+func regexSnippet(content string, loc []int) string {
+	start, end := loc[0], loc[1]
+	padStart := start - 40
+	if padStart < 0 {
+		padStart = 0
+	}
+	padEnd := end + 40
+	if padEnd > len(content) {
+		padEnd = len(content)
+	}
+	return content[padStart:start] + "<mark>" + content[start:end] + "</mark>" + content[end:padEnd]
+}
+
+// SearchSegments returns the top k documents for query, scored with
+// Okapi BM25 against a segment.Searcher; with phrase set, a multi-term
+// query only matches documents holding its terms at consecutive
+// positions. Term postings, corpus stats, and document content are
+// pulled from whichever
+// generation (base index or segment) most recently touched each
+// docID, so newly indexed and deleted documents are reflected without
+// a full rebuild.
+func SearchSegments(s *segment.Searcher, query string, k int, phrase bool) ([]Hit, error) {
+	docCount, avgLen := s.Stats()
+	if avgLen == 0 {
+		avgLen = 1
+	}
+
+	queryTerms := tokenize(query)
+	if len(queryTerms) == 0 {
+		return nil, nil
+	}
+	unique := make(map[string]bool, len(queryTerms))
+	for _, t := range queryTerms {
+		unique[t] = true
+	}
+	needPositions := phrase && len(unique) > 1
+
+	termTF := make(map[string]map[uint32]int, len(unique))
+	termPositions := make(map[string]map[uint32][]uint32, len(unique))
+	df := make(map[string]int, len(unique))
+	for t := range unique {
+		ids, positions := s.PostingsFor(t)
+		if len(ids) == 0 {
+			continue
+		}
+		df[t] = len(ids)
+		tf := make(map[uint32]int, len(ids))
+		for _, id := range ids {
+			tf[id] = len(positions[id])
+		}
+		termTF[t] = tf
+		if needPositions {
+			termPositions[t] = positions
+		}
+	}
+
+	lenCache := make(map[uint32]uint32)
+	scores := make(map[uint32]float64)
+	for t, tf := range termTF {
+		dfT := float64(df[t])
+		idf := math.Log((float64(docCount)-dfT+0.5)/(dfT+0.5) + 1)
+		for docID, termFreq := range tf {
+			length, ok := lenCache[docID]
+			if !ok {
+				length, _ = s.DocLength(docID)
+				lenCache[docID] = length
+			}
+			denom := float64(termFreq) + bm25K1*(1-bm25B+bm25B*float64(length)/avgLen)
+			scores[docID] += idf * (float64(termFreq) * (bm25K1 + 1)) / denom
+		}
+	}
+
+	if needPositions {
+		for docID := range scores {
+			if !hasPhrase(queryTerms, docID, termPositions) {
+				delete(scores, docID)
+			}
+		}
+	}
+
+	ids := make([]uint32, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return scores[ids[i]] > scores[ids[j]] })
+	if len(ids) > k {
+		ids = ids[:k]
+	}
+
+	hits := make([]Hit, 0, len(ids))
+	for _, id := range ids {
+		title, content, found := s.ReadDoc(id)
+		if !found {
+			continue
+		}
+		hits = append(hits, Hit{
+			DocID:   id,
+			Title:   title,
+			Score:   scores[id],
+			Snippet: bestSnippet(content, unique),
+		})
+	}
+	return hits, nil
+}
+
+// RegexSegments returns up to k live documents whose lowercased content
+// matches pattern, narrowing candidates with the segment.Searcher's
+// trigram indexes before verifying each one with the compiled regexp.
+func RegexSegments(s *segment.Searcher, pattern string, k int) ([]Hit, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	syn, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := s.CandidateDocsForRegex(syn)
+	hits := make([]Hit, 0, k)
+	for _, docID := range candidates {
+		title, content, found := s.ReadDoc(docID)
+		if !found {
+			continue
+		}
+		loc := re.FindStringIndex(strings.ToLower(content))
+		if loc == nil {
+			continue
+		}
+		hits = append(hits, Hit{
+			DocID:   docID,
+			Title:   title,
+			Snippet: regexSnippet(content, loc),
+		})
+		if len(hits) >= k {
+			break
+		}
+	}
+	return hits, nil
+}
+
+// hasPhrase reports whether docID has an occurrence of every term in
+// termsInOrder (duplicates included) at consecutive positions, in order.
+func hasPhrase(termsInOrder []string, docID uint32, termPostings map[string]map[uint32][]uint32) bool {
+	first := termPostings[termsInOrder[0]][docID]
+	sets := make([]map[uint32]bool, len(termsInOrder))
+	for i, t := range termsInOrder {
+		set := make(map[uint32]bool)
+		for _, p := range termPostings[t][docID] {
+			set[p] = true
+		}
+		sets[i] = set
+	}
+	for _, p0 := range first {
+		ok := true
+		for i := 1; i < len(termsInOrder); i++ {
+			if !sets[i][p0+uint32(i)] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+type tok struct {
+	word       string
+	start, end int
+}
+
+// tokenizeWithOffsets is tokenize but also records each token's byte
+// range in s, so a matched token can be sliced back out for snippeting.
+func tokenizeWithOffsets(s string) []tok {
+	var toks []tok
+	start := -1
+	for i, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start != -1 {
+			toks = append(toks, tok{word: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		toks = append(toks, tok{word: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return toks
+}
+
+// bestSnippet finds the smallest window of content covering the most
+// distinct terms in want, then wraps the matched tokens in <mark>.
+func bestSnippet(content string, want map[string]bool) string {
+	toks := tokenizeWithOffsets(content)
+	if len(toks) == 0 {
+		return ""
+	}
+
+	// target is how many distinct wanted terms content holds at all, so
+	// a window covering all of those counts as covering the most terms.
+	target := 0
+	present := make(map[string]bool)
+	for _, t := range toks {
+		if want[t.word] && !present[t.word] {
+			present[t.word] = true
+			target++
+		}
+	}
+
+	bestStart, bestEnd := -1, -1
+	count := make(map[string]int)
+	matched := 0
+	left := 0
+	for right, t := range toks {
+		if want[t.word] {
+			if count[t.word] == 0 {
+				matched++
+			}
+			count[t.word]++
+		}
+		for target > 0 && matched == target {
+			if bestStart == -1 || right-left < bestEnd-bestStart {
+				bestStart, bestEnd = left, right
+			}
+			lw := toks[left].word
+			if want[lw] {
+				count[lw]--
+				if count[lw] == 0 {
+					matched--
+				}
+			}
+			left++
+		}
+	}
+	if bestStart == -1 {
+		for i, t := range toks {
+			if want[t.word] {
+				bestStart, bestEnd = i, i
+				break
+			}
+		}
+	}
+	if bestStart == -1 {
+		bestStart, bestEnd = 0, 0
+		if len(toks) > 20 {
+			bestEnd = 20
+		} else {
+			bestEnd = len(toks) - 1
+		}
+	}
+
+	padStart := toks[bestStart].start - 40
+	if padStart < 0 {
+		padStart = 0
+	}
+	padEnd := toks[bestEnd].end + 40
+	if padEnd > len(content) {
+		padEnd = len(content)
+	}
+	window := content[padStart:padEnd]
+
+	var buf strings.Builder
+	i := 0
+	for _, t := range tokenizeWithOffsets(window) {
+		buf.WriteString(window[i:t.start])
+		if want[t.word] {
+			buf.WriteString("<mark>")
+			buf.WriteString(window[t.start:t.end])
+			buf.WriteString("</mark>")
+		} else {
+			buf.WriteString(window[t.start:t.end])
+		}
+		i = t.end
+	}
+	buf.WriteString(window[i:])
+	return buf.String()
+}
+
+func tokenize(s string) []string {
+	var tokens []string
+	var buf strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			buf.WriteRune(r)
+		} else if buf.Len() > 0 {
+			tokens = append(tokens, buf.String())
+			buf.Reset()
+		}
+	}
+	if buf.Len() > 0 {
+		tokens = append(tokens, buf.String())
+	}
+	return tokens
+}
@@ -0,0 +1,91 @@
+package search
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmcd/wikisearch/segment"
+)
+
+func TestHasPhrase(t *testing.T) {
+	postings := map[string]map[uint32][]uint32{
+		"quick": {1: {0, 10}},
+		"brown": {1: {1, 5}},
+		"fox":   {1: {2}},
+	}
+	if !hasPhrase([]string{"quick", "brown", "fox"}, 1, postings) {
+		t.Fatalf("hasPhrase: want true for consecutive quick(0) brown(1) fox(2)")
+	}
+	if hasPhrase([]string{"quick", "fox", "brown"}, 1, postings) {
+		t.Fatalf("hasPhrase: want false, quick/fox/brown isn't consecutive in that order")
+	}
+	if hasPhrase([]string{"quick", "brown", "fox"}, 2, postings) {
+		t.Fatalf("hasPhrase: want false, doc 2 has no postings at all")
+	}
+}
+
+func TestBestSnippet(t *testing.T) {
+	content := "The quick brown fox jumps over the lazy dog."
+	got := bestSnippet(content, map[string]bool{"fox": true})
+	want := "The quick brown <mark>fox</mark> jumps over the lazy dog."
+	if got != want {
+		t.Fatalf("bestSnippet = %q, want %q", got, want)
+	}
+
+	if got := bestSnippet("", map[string]bool{"fox": true}); got != "" {
+		t.Fatalf("bestSnippet(empty) = %q, want empty", got)
+	}
+}
+
+func TestSearchSegmentsAndRegexSegmentsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "public")
+
+	if _, err := segment.Build(base, 0, 0, []segment.ChangePage{
+		{ID: 1, Title: "Berlin", Text: "berlin is the capital of germany"},
+		{ID: 2, Title: "Paris", Text: "paris is the capital of france"},
+	}); err != nil {
+		t.Fatalf("segment.Build: %v", err)
+	}
+	segDir := filepath.Join(base, "index", "segments", "00001")
+	if _, err := segment.Build(segDir, 1, 1, []segment.ChangePage{
+		{ID: 3, Title: "Rome", Text: "rome is the capital of italy"},
+		{ID: 2, Deleted: true}, // segment deletes Paris
+	}); err != nil {
+		t.Fatalf("segment.Build(segment): %v", err)
+	}
+
+	s, err := segment.Open(base)
+	if err != nil {
+		t.Fatalf("segment.Open: %v", err)
+	}
+
+	hits, err := SearchSegments(s, "capital", 10, false)
+	if err != nil {
+		t.Fatalf("SearchSegments: %v", err)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("SearchSegments(capital): got %d hits, want 2 (Paris deleted)", len(hits))
+	}
+	for _, h := range hits {
+		if h.DocID == 2 {
+			t.Fatalf("SearchSegments(capital): hit %+v includes deleted doc 2", h)
+		}
+	}
+
+	hits, err = SearchSegments(s, "capital of germany", 10, true)
+	if err != nil {
+		t.Fatalf("SearchSegments phrase: %v", err)
+	}
+	if len(hits) != 1 || hits[0].DocID != 1 {
+		t.Fatalf("SearchSegments(capital of germany, phrase) = %+v, want one hit for doc 1", hits)
+	}
+
+	hits, err = RegexSegments(s, "ro.e", 10)
+	if err != nil {
+		t.Fatalf("RegexSegments: %v", err)
+	}
+	if len(hits) != 1 || hits[0].DocID != 3 {
+		t.Fatalf("RegexSegments(ro.e) = %+v, want one hit for doc 3 (Rome)", hits)
+	}
+}
@@ -0,0 +1,1190 @@
+// Package segment adds incremental indexing on top of the root
+// package's full-rebuild path: a change stream of added/updated/deleted
+// pages is indexed into its own small segment directory (same on-disk
+// layout main.go writes for a full index) instead of requiring a full
+// rebuild, and a Searcher transparently unions postings across all
+// segments, masking docIDs a newer segment has tombstoned.
+package segment
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/maxmcd/wikisearch/bitmap"
+	"github.com/maxmcd/wikisearch/chunk"
+	"github.com/maxmcd/wikisearch/trigram"
+	"github.com/maxmcd/wikisearch/wikitext"
+)
+
+// These mirror the sharding constants in the root package; every segment
+// (and the base index) must agree on them to hash terms and docs
+// consistently across the whole index.
+const (
+	ShardCount    = 4096
+	DocShardCount = 65536
+)
+
+// Meta is a segment's own meta.json, distinct from the root index's
+// meta.json: ID and Generation let a Searcher order segments and pick a
+// consistent snapshot, DocCount/AvgDocLen are this segment's own BM25
+// stats.
+type Meta struct {
+	ID            int     `json:"id"`
+	Generation    int     `json:"generation"`
+	DocCount      int     `json:"docCount"`
+	AvgDocLen     float64 `json:"avgDocLen"`
+	ShardCount    int     `json:"shardCount"`
+	DocShardCount int     `json:"docShardCount"`
+}
+
+// ChangePage is one entry in an incremental change stream: Deleted marks
+// a removal, otherwise it is an insert/update of ID with the given
+// title and raw wikitext.
+type ChangePage struct {
+	Title   string
+	ID      uint32
+	Text    string
+	Deleted bool
+}
+
+type changeStreamPage struct {
+	Title  string `xml:"title"`
+	ID     uint32 `xml:"id"`
+	NS     int    `xml:"ns"`
+	Text   string `xml:"revision>text"`
+	Action string `xml:"action,attr"`
+}
+
+type posting struct {
+	docID     uint32
+	positions []uint32
+}
+
+// ReadChangeStream decodes a bzip2-compressed change-stream XML file
+// (the same <page> shape dumps use, plus an action="delete" attribute
+// for removals) into ChangePages.
+func ReadChangeStream(path string) ([]ChangePage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pages []ChangePage
+	decoder := xml.NewDecoder(bzip2.NewReader(f))
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "page" {
+			continue
+		}
+		var p changeStreamPage
+		decoder.DecodeElement(&p, &se)
+		if p.NS != 0 {
+			continue
+		}
+		pages = append(pages, ChangePage{Title: p.Title, ID: p.ID, Text: p.Text, Deleted: p.Action == "delete"})
+	}
+	return pages, nil
+}
+
+// Build indexes pages into a new segment directory at root, writing the
+// same shard/doc/trigram layout the root package writes for a full
+// index, plus a tombstones.bin listing every ID this segment deletes or
+// supersedes via update.
+func Build(root string, id, generation int, pages []ChangePage) (Meta, error) {
+	if err := os.MkdirAll(root+"/index", 0755); err != nil {
+		return Meta{}, err
+	}
+	if err := os.MkdirAll(root+"/docs", 0755); err != nil {
+		return Meta{}, err
+	}
+
+	shards := make([]map[string][]posting, ShardCount)
+	for i := range shards {
+		shards[i] = make(map[string][]posting)
+	}
+	docShards := make([][]chunk.Document, DocShardCount)
+	trigramDocs := make([]trigram.Document, 0, len(pages))
+	lengths := make(map[uint32]uint32)
+
+	var tombstones []uint32
+	var totalDocLen uint64
+	docCount := 0
+
+	for _, p := range pages {
+		tombstones = append(tombstones, p.ID)
+		if p.Deleted {
+			continue
+		}
+
+		text := wikitext.Render(wikitext.Tokenize(p.Text))
+		tokens := tokenize(text)
+		lengths[p.ID] = uint32(len(tokens))
+		totalDocLen += uint64(len(tokens))
+		docCount++
+
+		docShard := p.ID % DocShardCount
+		docShards[docShard] = append(docShards[docShard], chunk.Document{ID: p.ID, Title: p.Title, Content: text})
+		trigramDocs = append(trigramDocs, trigram.Document{ID: p.ID, Title: p.Title, Content: text})
+
+		positions := make(map[string][]uint32)
+		for i, t := range tokens {
+			positions[t] = append(positions[t], uint32(i))
+		}
+		for t, pos := range positions {
+			shard := hash(t) % ShardCount
+			shards[shard][t] = append(shards[shard][t], posting{docID: p.ID, positions: pos})
+		}
+	}
+
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		sf, err := os.Create(fmt.Sprintf("%s/index/shard_%04d.bin", root, i))
+		if err != nil {
+			return Meta{}, err
+		}
+		bw := bufio.NewWriter(sf)
+
+		terms := make([]string, 0, len(shard))
+		for t := range shard {
+			terms = append(terms, t)
+		}
+		sort.Strings(terms)
+
+		for _, t := range terms {
+			postings := shard[t]
+			sort.Slice(postings, func(a, b int) bool { return postings[a].docID < postings[b].docID })
+			bw.WriteByte(byte(len(t)))
+			bw.WriteString(t)
+			writePostingList(bw, postings)
+		}
+		bw.Flush()
+		sf.Close()
+	}
+
+	chunk.WriteDocShards(root+"/docs", docShards)
+	for shardNum, docs := range docShards {
+		if len(docs) == 0 {
+			continue
+		}
+		lf, err := os.Create(fmt.Sprintf("%s/docs/doclen_%05d.bin", root, shardNum))
+		if err != nil {
+			return Meta{}, err
+		}
+		lbw := bufio.NewWriter(lf)
+		for _, doc := range docs {
+			writeVarint(lbw, lengths[doc.ID])
+		}
+		lbw.Flush()
+		lf.Close()
+	}
+	trigram.Build(root+"/index/trigram", trigramDocs)
+
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i] < tombstones[j] })
+	writeTombstones(root+"/index/tombstones.bin", tombstones)
+
+	var avgDocLen float64
+	if docCount > 0 {
+		avgDocLen = float64(totalDocLen) / float64(docCount)
+	}
+	m := Meta{
+		ID:            id,
+		Generation:    generation,
+		DocCount:      docCount,
+		AvgDocLen:     avgDocLen,
+		ShardCount:    ShardCount,
+		DocShardCount: DocShardCount,
+	}
+	mf, err := os.Create(root + "/index/meta.json")
+	if err != nil {
+		return Meta{}, err
+	}
+	defer mf.Close()
+	return m, json.NewEncoder(mf).Encode(m)
+}
+
+func writeTombstones(path string, ids []uint32) {
+	f, _ := os.Create(path)
+	bw := bufio.NewWriter(f)
+	var prev uint32
+	for _, id := range ids {
+		writeVarint(bw, id-prev)
+		prev = id
+	}
+	bw.Flush()
+	f.Close()
+}
+
+func readTombstones(path string) ([]uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	var ids []uint32
+	var prev uint32
+	for {
+		delta, err := binary.ReadUvarint(br)
+		if err != nil {
+			break
+		}
+		prev += uint32(delta)
+		ids = append(ids, prev)
+	}
+	return ids, nil
+}
+
+// writePostingList mirrors writePostingList in the root package: a
+// roaring-style doc bitmap, a parallel positions stream, and a skip
+// table, appended to bw. postings must already be sorted by docID.
+func writePostingList(bw *bufio.Writer, postings []posting) {
+	ids := make([]uint32, len(postings))
+	for i, p := range postings {
+		ids[i] = p.docID
+	}
+	bm := bitmap.FromSortedDocIDs(ids)
+
+	var docBuf, posBuf []byte
+	type skipEntry struct {
+		chunkKey      uint16
+		byteOffsetDoc uint32
+		byteOffsetPos uint32
+		cumulative    uint32
+	}
+	var skip []skipEntry
+	docIdx := 0
+	var cumulative uint32
+
+	for i := range bm.Chunks {
+		c := &bm.Chunks[i]
+		values := c.Values()
+		skip = append(skip, skipEntry{chunkKey: c.Key, byteOffsetDoc: uint32(len(docBuf)), byteOffsetPos: uint32(len(posBuf)), cumulative: cumulative})
+
+		docBuf = appendUint16(docBuf, c.Key)
+		docBuf = appendUvarint(docBuf, uint32(c.Cardinality()))
+		docBuf = append(docBuf, byte(c.Type))
+		if c.Type == bitmap.ArrayContainer {
+			for _, v := range values {
+				docBuf = appendUint16(docBuf, v)
+			}
+		} else {
+			for _, w := range c.Words {
+				docBuf = appendUint64(docBuf, w)
+			}
+		}
+
+		for range values {
+			p := postings[docIdx]
+			docIdx++
+			posBuf = appendUvarint(posBuf, uint32(len(p.positions)))
+			var prevPos uint32
+			for _, pos := range p.positions {
+				posBuf = appendUvarint(posBuf, pos-prevPos)
+				prevPos = pos
+			}
+		}
+		cumulative += uint32(c.Cardinality())
+	}
+
+	writeVarint(bw, uint32(len(skip)))
+	for _, e := range skip {
+		binary.Write(bw, binary.LittleEndian, e.chunkKey)
+		writeVarint(bw, e.byteOffsetDoc)
+		writeVarint(bw, e.byteOffsetPos)
+		writeVarint(bw, e.cumulative)
+	}
+	writeVarint(bw, uint32(len(docBuf)))
+	bw.Write(docBuf)
+	writeVarint(bw, uint32(len(posBuf)))
+	bw.Write(posBuf)
+}
+
+func appendUvarint(buf []byte, v uint32) []byte {
+	var tmp [5]byte
+	n := binary.PutUvarint(tmp[:], uint64(v))
+	return append(buf, tmp[:n]...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func writeVarint(w io.Writer, v uint32) {
+	var buf [5]byte
+	n := binary.PutUvarint(buf[:], uint64(v))
+	w.Write(buf[:n])
+}
+
+func tokenize(s string) []string {
+	var tokens []string
+	var buf strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			buf.WriteRune(r)
+		} else if buf.Len() > 0 {
+			tokens = append(tokens, buf.String())
+			buf.Reset()
+		}
+	}
+	if buf.Len() > 0 {
+		tokens = append(tokens, buf.String())
+	}
+	return tokens
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// root is one searchable directory: either the base index (generation
+// 0) or a segment built by Build.
+type root struct {
+	dir  string
+	gen  int
+	meta Meta
+}
+
+// Searcher opens the base index plus every segment under
+// <base>/index/segments and answers postings queries against their
+// union, filtering out docIDs that the newest touching generation
+// tombstoned.
+type Searcher struct {
+	base  string
+	roots []root
+	live  map[uint32]bool
+	// tombGen is the newest generation that tombstoned each docID; a
+	// root's copy of a docID is masked when tombGen is above its own.
+	tombGen map[uint32]int
+}
+
+// Open discovers the base index and all segment directories under base
+// and prepares them for querying.
+func Open(base string) (*Searcher, error) {
+	var roots []root
+
+	if m, err := loadBaseMeta(base); err == nil {
+		roots = append(roots, root{dir: base, gen: 0, meta: m})
+	}
+
+	segDirs, _ := filepath.Glob(base + "/index/segments/*")
+	sort.Strings(segDirs)
+	for _, d := range segDirs {
+		mf, err := os.Open(d + "/index/meta.json")
+		if err != nil {
+			continue
+		}
+		var m Meta
+		err = json.NewDecoder(mf).Decode(&m)
+		mf.Close()
+		if err != nil {
+			continue
+		}
+		roots = append(roots, root{dir: d, gen: m.Generation, meta: m})
+	}
+
+	sort.Slice(roots, func(i, j int) bool { return roots[i].gen < roots[j].gen })
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("segment: no base index or segments found under %s", base)
+	}
+
+	s := &Searcher{base: base, roots: roots}
+	s.live = s.computeLiveness()
+	return s, nil
+}
+
+func loadBaseMeta(base string) (Meta, error) {
+	f, err := os.Open(base + "/index/meta.json")
+	if err != nil {
+		return Meta{}, err
+	}
+	defer f.Close()
+	var raw struct {
+		DocCount      int     `json:"docCount"`
+		ShardCount    int     `json:"shardCount"`
+		DocShardCount int     `json:"docShardCount"`
+		AvgDocLen     float64 `json:"avgDocLen"`
+	}
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return Meta{}, err
+	}
+	return Meta{ID: -1, Generation: 0, DocCount: raw.DocCount, AvgDocLen: raw.AvgDocLen, ShardCount: raw.ShardCount, DocShardCount: raw.DocShardCount}, nil
+}
+
+// computeLiveness decides, for every docID any root mentions, whether
+// its most recent appearance (by generation) was an insert or a
+// tombstone: an update re-inserts at the same generation it tombstones
+// the old copy at, so ties favor the insert.
+func (s *Searcher) computeLiveness() map[uint32]bool {
+	postingGen := make(map[uint32]int)
+	tombGen := make(map[uint32]int)
+
+	for _, r := range s.roots {
+		docCount := r.meta.DocShardCount
+		if docCount == 0 {
+			docCount = DocShardCount
+		}
+		for shardNum := uint32(0); shardNum < uint32(docCount); shardNum++ {
+			ids, err := chunk.DocIDs(r.dir+"/docs", shardNum)
+			if err != nil {
+				continue
+			}
+			for _, id := range ids {
+				if g, ok := postingGen[id]; !ok || r.gen > g {
+					postingGen[id] = r.gen
+				}
+			}
+		}
+		tomb, _ := readTombstones(r.dir + "/index/tombstones.bin")
+		for _, id := range tomb {
+			if g, ok := tombGen[id]; !ok || r.gen > g {
+				tombGen[id] = r.gen
+			}
+		}
+	}
+
+	live := make(map[uint32]bool, len(postingGen))
+	for id, pg := range postingGen {
+		if tg, ok := tombGen[id]; !ok || pg >= tg {
+			live[id] = true
+		}
+	}
+	s.tombGen = tombGen
+	return live
+}
+
+// PostingsFor returns term's docIDs and positions, unioned across every
+// open root and filtered to currently live documents; a root's posting
+// for a docID that a newer root tombstoned is skipped, and a newer
+// root's posting for a docID supersedes an older root's.
+func (s *Searcher) PostingsFor(term string) ([]uint32, map[uint32][]uint32) {
+	merged := make(map[uint32][]uint32)
+	for _, r := range s.roots {
+		ids, positions, found := lookupTerm(r.dir+"/index", term)
+		if !found {
+			continue
+		}
+		for i, id := range ids {
+			if !s.live[id] || s.tombGen[id] > r.gen {
+				continue
+			}
+			merged[id] = positions[i]
+		}
+	}
+	docIDs := make([]uint32, 0, len(merged))
+	for id := range merged {
+		docIDs = append(docIDs, id)
+	}
+	sort.Slice(docIDs, func(i, j int) bool { return docIDs[i] < docIDs[j] })
+	return docIDs, merged
+}
+
+// Stats returns the live document count and average live document
+// length across every open root, the corpus-wide numbers a BM25 scorer
+// needs.
+func (s *Searcher) Stats() (docCount int, avgDocLen float64) {
+	// A live docID can have a posting in more than one root at once (an
+	// update writes a fresh copy into the newer segment without erasing
+	// the old one, only tombstoning it), so lengths is keyed by docID
+	// and overwritten root-by-root in oldest-first order: the last write
+	// wins, the same "newer root supersedes" rule PostingsFor applies.
+	lengths := make(map[uint32]uint32)
+	for _, r := range s.roots {
+		shardCount := r.meta.DocShardCount
+		if shardCount == 0 {
+			shardCount = DocShardCount
+		}
+		for shardNum := uint32(0); shardNum < uint32(shardCount); shardNum++ {
+			ids, err := chunk.DocIDs(r.dir+"/docs", shardNum)
+			if err != nil {
+				continue
+			}
+			docLens := readDocLengths(r.dir+"/docs", shardNum, ids)
+			for _, id := range ids {
+				if !s.live[id] {
+					continue
+				}
+				lengths[id] = docLens[id]
+			}
+		}
+	}
+	var totalLen uint64
+	for _, l := range lengths {
+		totalLen += uint64(l)
+	}
+	docCount = len(lengths)
+	if docCount > 0 {
+		avgDocLen = float64(totalLen) / float64(docCount)
+	}
+	return docCount, avgDocLen
+}
+
+// ReadDoc returns docID's title and content, trying roots newest
+// generation first so an update's content wins over the stale copy its
+// tombstone supersedes. It does not itself check liveness, so callers
+// that want dead docs excluded should consult Live first.
+func (s *Searcher) ReadDoc(docID uint32) (title, content string, found bool) {
+	for i := len(s.roots) - 1; i >= 0; i-- {
+		r := s.roots[i]
+		shardCount := r.meta.DocShardCount
+		if shardCount == 0 {
+			shardCount = DocShardCount
+		}
+		title, content, found = chunk.ReadDoc(r.dir+"/docs", docID%uint32(shardCount), docID)
+		if found {
+			return title, content, true
+		}
+	}
+	return "", "", false
+}
+
+// DocLength returns docID's token count, trying roots newest generation
+// first to match ReadDoc's choice of which root's copy wins.
+func (s *Searcher) DocLength(docID uint32) (uint32, bool) {
+	for i := len(s.roots) - 1; i >= 0; i-- {
+		r := s.roots[i]
+		shardCount := r.meta.DocShardCount
+		if shardCount == 0 {
+			shardCount = DocShardCount
+		}
+		shardNum := docID % uint32(shardCount)
+		ids, err := chunk.DocIDs(r.dir+"/docs", shardNum)
+		if err != nil {
+			continue
+		}
+		found := false
+		for _, id := range ids {
+			if id == docID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		lengths := readDocLengths(r.dir+"/docs", shardNum, ids)
+		return lengths[docID], true
+	}
+	return 0, false
+}
+
+// Live reports whether docID's most recent appearance across every open
+// root was an insert rather than a tombstone.
+func (s *Searcher) Live(docID uint32) bool {
+	return s.live[docID]
+}
+
+// CandidateDocsForRegex unions trigram.CandidateDocs across every open
+// root and filters out tombstoned docIDs, mirroring PostingsFor's
+// liveness handling for the trigram index.
+func (s *Searcher) CandidateDocsForRegex(re *syntax.Regexp) []uint32 {
+	seen := make(map[uint32]bool)
+	for _, r := range s.roots {
+		for _, id := range trigram.CandidateDocs(r.dir+"/index/trigram", re) {
+			if s.live[id] && s.tombGen[id] <= r.gen {
+				seen[id] = true
+			}
+		}
+	}
+	out := make([]uint32, 0, len(seen))
+	for id := range seen {
+		out = append(out, id)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// lookupTerm scans indexDir's shard for term (each shard is written in
+// sorted term order, so a linear scan is enough).
+func lookupTerm(indexDir, term string) (docIDs []uint32, positions [][]uint32, found bool) {
+	shard := hash(term) % ShardCount
+	f, err := os.Open(fmt.Sprintf("%s/shard_%04d.bin", indexDir, shard))
+	if err != nil {
+		return nil, nil, false
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	for {
+		tlen, err := br.ReadByte()
+		if err != nil {
+			break
+		}
+		tbuf := make([]byte, tlen)
+		io.ReadFull(br, tbuf)
+		t := string(tbuf)
+
+		ids, pos := decodePostingList(br)
+		switch {
+		case t == term:
+			return ids, pos, true
+		case t > term:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
+
+func decodePostingList(br *bufio.Reader) ([]uint32, [][]uint32) {
+	numChunks, _ := binary.ReadUvarint(br)
+	for i := uint64(0); i < numChunks; i++ {
+		var key uint16
+		binary.Read(br, binary.LittleEndian, &key)
+		binary.ReadUvarint(br)
+		binary.ReadUvarint(br)
+		binary.ReadUvarint(br)
+	}
+
+	docLen, _ := binary.ReadUvarint(br)
+	docBuf := make([]byte, docLen)
+	io.ReadFull(br, docBuf)
+	posLen, _ := binary.ReadUvarint(br)
+	posBuf := make([]byte, posLen)
+	io.ReadFull(br, posBuf)
+
+	dr := bufio.NewReader(strings.NewReader(string(docBuf)))
+	pr := bufio.NewReader(strings.NewReader(string(posBuf)))
+
+	var docIDs []uint32
+	var positions [][]uint32
+	for {
+		var key uint16
+		if err := binary.Read(dr, binary.LittleEndian, &key); err != nil {
+			break
+		}
+		card, _ := binary.ReadUvarint(dr)
+		tag, _ := dr.ReadByte()
+
+		var lows []uint16
+		if bitmap.ContainerType(tag) == bitmap.ArrayContainer {
+			for i := uint64(0); i < card; i++ {
+				var v uint16
+				binary.Read(dr, binary.LittleEndian, &v)
+				lows = append(lows, v)
+			}
+		} else {
+			var words [1024]uint64
+			binary.Read(dr, binary.LittleEndian, &words)
+			for wi, w := range words {
+				for w != 0 {
+					lows = append(lows, uint16(wi*64+trailingZeros(w)))
+					w &= w - 1
+				}
+			}
+		}
+
+		for _, low := range lows {
+			docID := uint32(key)<<16 | uint32(low)
+			n, _ := binary.ReadUvarint(pr)
+			var prev uint32
+			pos := make([]uint32, n)
+			for j := uint64(0); j < n; j++ {
+				d, _ := binary.ReadUvarint(pr)
+				prev += uint32(d)
+				pos[j] = prev
+			}
+			docIDs = append(docIDs, docID)
+			positions = append(positions, pos)
+		}
+	}
+	return docIDs, positions
+}
+
+func trailingZeros(w uint64) int {
+	n := 0
+	for w&1 == 0 {
+		w >>= 1
+		n++
+	}
+	return n
+}
+
+// Compact k-way merges the segments at dirs (given oldest-generation
+// first) into a single new segment at outRoot, dropping any docID the
+// merge set's tombstones mark dead. Every input shard file already
+// stores its keys (terms, trigrams) in sorted order, so term and
+// trigram postings are merged via sorted-stream merges of the decoded
+// shard entries, and each live doc's chunks are copied forward by
+// reference from the newest root holding it — no document is ever
+// retokenized or has its content reconstructed.
+func Compact(outRoot string, id, generation int, dirs []string) (Meta, error) {
+	roots, err := loadCompactRoots(dirs)
+	if err != nil {
+		return Meta{}, err
+	}
+
+	s := &Searcher{roots: roots}
+	s.live = s.computeLiveness()
+
+	if err := os.MkdirAll(outRoot+"/index", 0755); err != nil {
+		return Meta{}, err
+	}
+	if err := os.MkdirAll(outRoot+"/docs", 0755); err != nil {
+		return Meta{}, err
+	}
+
+	docCount, totalDocLen, err := mergeDocShards(outRoot, roots, s.live)
+	if err != nil {
+		return Meta{}, err
+	}
+	if err := mergeTermShards(outRoot, roots, s.live); err != nil {
+		return Meta{}, err
+	}
+	if err := mergeTrigramShards(outRoot, roots, s.live); err != nil {
+		return Meta{}, err
+	}
+	// The compacted segment carries forward every input root's
+	// tombstones, so deletions and updates recorded in the merge set
+	// still mask copies in roots outside it. Docs kept by the merge are
+	// inserted at this segment's own generation, and ties favor the
+	// insert, so they stay live.
+	var tombstones []uint32
+	seenTomb := make(map[uint32]bool)
+	for _, r := range roots {
+		tomb, _ := readTombstones(r.dir + "/index/tombstones.bin")
+		for _, tid := range tomb {
+			if !seenTomb[tid] {
+				seenTomb[tid] = true
+				tombstones = append(tombstones, tid)
+			}
+		}
+	}
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i] < tombstones[j] })
+	writeTombstones(outRoot+"/index/tombstones.bin", tombstones)
+
+	var avgDocLen float64
+	if docCount > 0 {
+		avgDocLen = totalDocLen / float64(docCount)
+	}
+	m := Meta{ID: id, Generation: generation, DocCount: docCount, AvgDocLen: avgDocLen, ShardCount: ShardCount, DocShardCount: DocShardCount}
+	mf, err := os.Create(outRoot + "/index/meta.json")
+	if err != nil {
+		return Meta{}, err
+	}
+	defer mf.Close()
+	return m, json.NewEncoder(mf).Encode(m)
+}
+
+func loadCompactRoots(dirs []string) ([]root, error) {
+	var roots []root
+	for i, d := range dirs {
+		mf, err := os.Open(d + "/index/meta.json")
+		if err != nil {
+			return nil, err
+		}
+		var m Meta
+		err = json.NewDecoder(mf).Decode(&m)
+		mf.Close()
+		if err != nil {
+			return nil, err
+		}
+		if m.Generation == 0 {
+			m.Generation = i // base index carries no explicit generation; dirs is already oldest-first
+		}
+		roots = append(roots, root{dir: d, gen: m.Generation, meta: m})
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].gen < roots[j].gen })
+	return roots, nil
+}
+
+// mergeDocShards copies each live doc's title and chunk references
+// forward from the newest root that has it, pulling the chunk bytes
+// those references point to directly from the source chunks file rather
+// than reconstructing the doc's text. Roots must be oldest-generation
+// first, so the last root seen for a given ID wins.
+func mergeDocShards(outRoot string, roots []root, live map[uint32]bool) (docCount int, totalDocLen float64, err error) {
+	type winner struct {
+		title  string
+		refs   []chunk.Ref
+		dir    string
+		shard  uint32
+		length uint32
+	}
+	winners := make(map[uint32]winner)
+
+	for _, r := range roots {
+		shardCount := r.meta.DocShardCount
+		if shardCount == 0 {
+			shardCount = DocShardCount
+		}
+		for shardNum := uint32(0); shardNum < uint32(shardCount); shardNum++ {
+			refsList, err := chunk.ReadAllDocRefs(r.dir+"/docs", shardNum)
+			if err != nil {
+				continue
+			}
+			ids := make([]uint32, len(refsList))
+			for i, dr := range refsList {
+				ids[i] = dr.ID
+			}
+			lengths := readDocLengths(r.dir+"/docs", shardNum, ids)
+			for _, dr := range refsList {
+				if !live[dr.ID] {
+					continue
+				}
+				winners[dr.ID] = winner{title: dr.Title, refs: dr.Refs, dir: r.dir, shard: shardNum, length: lengths[dr.ID]}
+			}
+		}
+	}
+
+	docShards := make([][]chunk.RawDoc, DocShardCount)
+	for docID, w := range winners {
+		bytesList := make([][]byte, len(w.refs))
+		for i, ref := range w.refs {
+			b, ok := chunk.ReadChunk(w.dir+"/docs", w.shard, ref)
+			if !ok {
+				continue
+			}
+			bytesList[i] = b
+		}
+		shard := docID % DocShardCount
+		docShards[shard] = append(docShards[shard], chunk.RawDoc{ID: docID, Title: w.title, Refs: w.refs, Bytes: bytesList})
+		totalDocLen += float64(w.length)
+		docCount++
+	}
+	for i := range docShards {
+		sort.Slice(docShards[i], func(a, b int) bool { return docShards[i][a].ID < docShards[i][b].ID })
+	}
+
+	chunk.WriteRawDocShards(outRoot+"/docs", docShards)
+	for shardNum, docs := range docShards {
+		if len(docs) == 0 {
+			continue
+		}
+		lf, err := os.Create(fmt.Sprintf("%s/docs/doclen_%05d.bin", outRoot, shardNum))
+		if err != nil {
+			return 0, 0, err
+		}
+		lbw := bufio.NewWriter(lf)
+		for _, doc := range docs {
+			writeVarint(lbw, winners[doc.ID].length)
+		}
+		lbw.Flush()
+		lf.Close()
+	}
+	return docCount, totalDocLen, nil
+}
+
+// termShardCursor reads one root's term shard file one term entry at a
+// time, in the sorted order writePostingList's caller already wrote
+// them in.
+type termShardCursor struct {
+	f    *os.File
+	br   *bufio.Reader
+	term string
+	ids  []uint32
+	pos  [][]uint32
+	ok   bool
+}
+
+func openTermShardCursor(path string) *termShardCursor {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	c := &termShardCursor{f: f, br: bufio.NewReader(f)}
+	c.advance()
+	return c
+}
+
+func (c *termShardCursor) advance() {
+	tlen, err := c.br.ReadByte()
+	if err != nil {
+		c.ok = false
+		c.f.Close()
+		return
+	}
+	tbuf := make([]byte, tlen)
+	io.ReadFull(c.br, tbuf)
+	c.term = string(tbuf)
+	c.ids, c.pos = decodePostingList(c.br)
+	c.ok = true
+}
+
+// mergeTermShards k-way merges every root's term shard files: each
+// shard's cursors are advanced in lockstep over the lexicographically
+// smallest term among them, and postings for that term are combined
+// (live filter applied, newest root's positions winning for a docID
+// present in more than one root) straight from the decoded postings —
+// no term is ever recomputed from document text.
+func mergeTermShards(outRoot string, roots []root, live map[uint32]bool) error {
+	for shardNum := 0; shardNum < ShardCount; shardNum++ {
+		var cursors []*termShardCursor
+		for _, r := range roots {
+			path := fmt.Sprintf("%s/index/shard_%04d.bin", r.dir, shardNum)
+			if c := openTermShardCursor(path); c != nil {
+				if c.ok {
+					cursors = append(cursors, c)
+				}
+			}
+		}
+		if len(cursors) == 0 {
+			continue
+		}
+
+		var sf *os.File
+		var bw *bufio.Writer
+		for {
+			minTerm, any := "", false
+			for _, c := range cursors {
+				if c.ok && (!any || c.term < minTerm) {
+					minTerm, any = c.term, true
+				}
+			}
+			if !any {
+				break
+			}
+
+			merged := make(map[uint32][]uint32)
+			for _, c := range cursors {
+				if !c.ok || c.term != minTerm {
+					continue
+				}
+				for i, id := range c.ids {
+					if live[id] {
+						merged[id] = c.pos[i]
+					}
+				}
+			}
+			if len(merged) > 0 {
+				if bw == nil {
+					var err error
+					sf, err = os.Create(fmt.Sprintf("%s/index/shard_%04d.bin", outRoot, shardNum))
+					if err != nil {
+						return err
+					}
+					bw = bufio.NewWriter(sf)
+				}
+				postings := make([]posting, 0, len(merged))
+				for docID, pos := range merged {
+					postings = append(postings, posting{docID: docID, positions: pos})
+				}
+				sort.Slice(postings, func(a, b int) bool { return postings[a].docID < postings[b].docID })
+				bw.WriteByte(byte(len(minTerm)))
+				bw.WriteString(minTerm)
+				writePostingList(bw, postings)
+			}
+
+			for _, c := range cursors {
+				if c.ok && c.term == minTerm {
+					c.advance()
+				}
+			}
+		}
+		if bw != nil {
+			bw.Flush()
+			sf.Close()
+		}
+	}
+	return nil
+}
+
+// trigramShardCursor reads one root's trigram shard file one
+// (trigram, field) entry at a time, mirroring trigram.Build's on-disk
+// layout: a 3-byte trigram, a 1-byte field tag, a varint posting count,
+// then that many (docID delta, offset count, offset deltas) groups.
+type trigramShardCursor struct {
+	f     *os.File
+	br    *bufio.Reader
+	key   [3]byte
+	field byte
+	ids   []uint32
+	offs  [][]uint32
+	ok    bool
+}
+
+func openTrigramShardCursor(path string) *trigramShardCursor {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	c := &trigramShardCursor{f: f, br: bufio.NewReader(f)}
+	c.advance()
+	return c
+}
+
+func (c *trigramShardCursor) advance() {
+	var key [3]byte
+	if _, err := io.ReadFull(c.br, key[:]); err != nil {
+		c.ok = false
+		c.f.Close()
+		return
+	}
+	field, err := c.br.ReadByte()
+	if err != nil {
+		c.ok = false
+		c.f.Close()
+		return
+	}
+	count, _ := binary.ReadUvarint(c.br)
+	ids := make([]uint32, count)
+	offs := make([][]uint32, count)
+	var docID uint32
+	for i := uint64(0); i < count; i++ {
+		delta, _ := binary.ReadUvarint(c.br)
+		docID += uint32(delta)
+		ids[i] = docID
+		n, _ := binary.ReadUvarint(c.br)
+		offsets := make([]uint32, n)
+		var prev uint32
+		for j := uint64(0); j < n; j++ {
+			d, _ := binary.ReadUvarint(c.br)
+			prev += uint32(d)
+			offsets[j] = prev
+		}
+		offs[i] = offsets
+	}
+	c.key, c.field, c.ids, c.offs, c.ok = key, field, ids, offs, true
+}
+
+func trigramKeyLess(aKey [3]byte, aField byte, bKey [3]byte, bField byte) bool {
+	if aKey != bKey {
+		return string(aKey[:]) < string(bKey[:])
+	}
+	return aField < bField
+}
+
+// mergeTrigramShards k-way merges every root's trigram shard files, the
+// same way mergeTermShards merges word postings: no document's trigrams
+// are ever recomputed from its text.
+func mergeTrigramShards(outRoot string, roots []root, live map[uint32]bool) error {
+	if err := os.MkdirAll(outRoot+"/index/trigram", 0755); err != nil {
+		return err
+	}
+
+	for shardNum := 0; shardNum < trigram.ShardCount; shardNum++ {
+		var cursors []*trigramShardCursor
+		for _, r := range roots {
+			path := fmt.Sprintf("%s/index/trigram/shard_%04d.bin", r.dir, shardNum)
+			if c := openTrigramShardCursor(path); c != nil {
+				if c.ok {
+					cursors = append(cursors, c)
+				}
+			}
+		}
+		if len(cursors) == 0 {
+			continue
+		}
+
+		var sf *os.File
+		var bw *bufio.Writer
+		for {
+			var minKey [3]byte
+			var minField byte
+			any := false
+			for _, c := range cursors {
+				if c.ok && (!any || trigramKeyLess(c.key, c.field, minKey, minField)) {
+					minKey, minField, any = c.key, c.field, true
+				}
+			}
+			if !any {
+				break
+			}
+
+			merged := make(map[uint32][]uint32)
+			for _, c := range cursors {
+				if !c.ok || c.key != minKey || c.field != minField {
+					continue
+				}
+				for i, id := range c.ids {
+					if live[id] {
+						merged[id] = c.offs[i]
+					}
+				}
+			}
+			if len(merged) > 0 {
+				if bw == nil {
+					var err error
+					sf, err = os.Create(fmt.Sprintf("%s/index/trigram/shard_%04d.bin", outRoot, shardNum))
+					if err != nil {
+						return err
+					}
+					bw = bufio.NewWriter(sf)
+				}
+				ids := make([]uint32, 0, len(merged))
+				for docID := range merged {
+					ids = append(ids, docID)
+				}
+				sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+
+				bw.Write(minKey[:])
+				bw.WriteByte(minField)
+				writeVarint(bw, uint32(len(ids)))
+				var prevDoc uint32
+				for _, docID := range ids {
+					writeVarint(bw, docID-prevDoc)
+					prevDoc = docID
+					offs := merged[docID]
+					writeVarint(bw, uint32(len(offs)))
+					var prevOff uint32
+					for _, off := range offs {
+						writeVarint(bw, off-prevOff)
+						prevOff = off
+					}
+				}
+			}
+
+			for _, c := range cursors {
+				if c.ok && c.key == minKey && c.field == minField {
+					c.advance()
+				}
+			}
+		}
+		if bw != nil {
+			bw.Flush()
+			sf.Close()
+		}
+	}
+
+	mf, err := os.Create(outRoot + "/index/trigram/meta.json")
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+	return json.NewEncoder(mf).Encode(struct {
+		ShardCount int `json:"shardCount"`
+	}{ShardCount: trigram.ShardCount})
+}
+
+func readDocLengths(docsDir string, shardNum uint32, ids []uint32) map[uint32]uint32 {
+	lf, err := os.Open(fmt.Sprintf("%s/doclen_%05d.bin", docsDir, shardNum))
+	if err != nil {
+		return nil
+	}
+	defer lf.Close()
+	br := bufio.NewReader(lf)
+	out := make(map[uint32]uint32, len(ids))
+	for _, id := range ids {
+		length, _ := binary.ReadUvarint(br)
+		out[id] = uint32(length)
+	}
+	return out
+}
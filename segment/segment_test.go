@@ -0,0 +1,100 @@
+package segment
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSearcherTombstoneLiveness(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "public")
+
+	if _, err := Build(base, 0, 0, []ChangePage{
+		{ID: 1, Title: "Alpha", Text: "alpha one"},
+		{ID: 2, Title: "Beta", Text: "alpha two"},
+	}); err != nil {
+		t.Fatalf("Build(base): %v", err)
+	}
+
+	segDir := filepath.Join(base, "index", "segments", "seg0001")
+	if _, err := Build(segDir, 1, 1, []ChangePage{
+		{ID: 1, Title: "Alpha", Text: "alpha updated"}, // update supersedes the base copy
+		{ID: 2, Deleted: true},                         // delete drops the base copy
+	}); err != nil {
+		t.Fatalf("Build(segment): %v", err)
+	}
+
+	s, err := Open(base)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if !s.live[1] {
+		t.Fatalf("doc 1 should be live after an update")
+	}
+	if s.live[2] {
+		t.Fatalf("doc 2 should be dead after a delete")
+	}
+
+	if ids, _ := s.PostingsFor("two"); len(ids) != 0 {
+		t.Fatalf("PostingsFor(two) = %v, want none (doc 2 deleted)", ids)
+	}
+	ids, _ := s.PostingsFor("updated")
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("PostingsFor(updated) = %v, want [1]", ids)
+	}
+	ids, _ = s.PostingsFor("alpha")
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("PostingsFor(alpha) = %v, want [1] (doc 2's copy is dead)", ids)
+	}
+
+	// Doc 1's content lives on in both the base index (its pre-update
+	// copy) and the segment (its update), so Stats must count it once,
+	// not once per root that still carries a copy.
+	if docCount, _ := s.Stats(); docCount != 1 {
+		t.Fatalf("Stats() docCount = %d, want 1 (doc 1 counted once despite appearing in two roots)", docCount)
+	}
+}
+
+func TestCompactMergesSegmentsWithoutRetokenizing(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "public")
+	segDir := filepath.Join(base, "index", "segments", "seg0001")
+	out := filepath.Join(dir, "compacted")
+
+	if _, err := Build(base, 0, 0, []ChangePage{
+		{ID: 1, Title: "Alpha", Text: "alpha one"},
+		{ID: 2, Title: "Beta", Text: "alpha two"},
+	}); err != nil {
+		t.Fatalf("Build(base): %v", err)
+	}
+	if _, err := Build(segDir, 1, 1, []ChangePage{
+		{ID: 1, Title: "Alpha", Text: "alpha updated"},
+		{ID: 2, Deleted: true},
+	}); err != nil {
+		t.Fatalf("Build(segment): %v", err)
+	}
+
+	if _, err := Compact(out, 2, 2, []string{base, segDir}); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	s, err := Open(out)
+	if err != nil {
+		t.Fatalf("Open(compacted): %v", err)
+	}
+	if len(s.roots) != 1 || s.roots[0].meta.DocCount != 1 {
+		t.Fatalf("compacted segment has DocCount %d, want 1", s.roots[0].meta.DocCount)
+	}
+	if !s.live[1] || s.live[2] {
+		t.Fatalf("compacted liveness = {1:%v 2:%v}, want {1:true 2:false}", s.live[1], s.live[2])
+	}
+
+	if ids, _ := s.PostingsFor("two"); len(ids) != 0 {
+		t.Fatalf("PostingsFor(two) = %v, want none", ids)
+	}
+	ids, _ := s.PostingsFor("updated")
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("PostingsFor(updated) = %v, want [1]", ids)
+	}
+}
@@ -0,0 +1,402 @@
+// Package trigram builds and queries a trigram index so the token index
+// can be complemented with substring and regex search over article
+// titles and bodies. Each shard entry is keyed by a fixed 3-byte trigram
+// and a field tag and holds varint-delta docID + byte-offset lists,
+// unlike the root package's word-postings shards, which store roaring-
+// style doc-ID bitmaps.
+package trigram
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// ShardCount is the number of trigram shard files written by Build.
+const ShardCount = 1024
+
+// Document is the minimal view of an indexed article Build needs; the
+// caller constructs these from its own Doc type.
+type Document struct {
+	ID      uint32
+	Title   string
+	Content string
+}
+
+// Posting is one document's occurrences of a trigram, as byte offsets
+// into that field's text.
+type Posting struct {
+	DocID   uint32
+	Offsets []uint32
+}
+
+// field tags which text a trigram was found in, so title and content
+// hits can be told apart without a second index.
+type field byte
+
+const (
+	fieldContent field = 0
+	fieldTitle   field = 1
+)
+
+type trigramKey struct {
+	tri   [3]byte
+	field field
+}
+
+func shardFor(tri [3]byte) uint32 {
+	h := fnv.New32a()
+	h.Write(tri[:])
+	return h.Sum32() % ShardCount
+}
+
+// Build writes the trigram index for docs into outDir/shard_NNNN.bin,
+// plus outDir/meta.json recording ShardCount.
+func Build(outDir string, docs []Document) {
+	os.MkdirAll(outDir, 0755)
+
+	shards := make([]map[trigramKey][]Posting, ShardCount)
+	for i := range shards {
+		shards[i] = make(map[trigramKey][]Posting)
+	}
+
+	index := func(doc Document, text string, f field) {
+		text = strings.ToLower(text)
+		offsets := make(map[[3]byte][]uint32)
+		b := []byte(text)
+		for i := 0; i+3 <= len(b); i++ {
+			var tri [3]byte
+			copy(tri[:], b[i:i+3])
+			offsets[tri] = append(offsets[tri], uint32(i))
+		}
+		for tri, offs := range offsets {
+			key := trigramKey{tri: tri, field: f}
+			shard := shardFor(tri)
+			shards[shard][key] = append(shards[shard][key], Posting{DocID: doc.ID, Offsets: offs})
+		}
+	}
+
+	for _, doc := range docs {
+		index(doc, doc.Content, fieldContent)
+		index(doc, doc.Title, fieldTitle)
+	}
+
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		sf, _ := os.Create(fmt.Sprintf("%s/shard_%04d.bin", outDir, i))
+		bw := bufio.NewWriter(sf)
+
+		keys := make([]trigramKey, 0, len(shard))
+		for k := range shard {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(a, b int) bool {
+			if keys[a].tri != keys[b].tri {
+				return string(keys[a].tri[:]) < string(keys[b].tri[:])
+			}
+			return keys[a].field < keys[b].field
+		})
+
+		for _, k := range keys {
+			bw.Write(k.tri[:])
+			bw.WriteByte(byte(k.field))
+
+			postings := shard[k]
+			sort.Slice(postings, func(a, b int) bool { return postings[a].DocID < postings[b].DocID })
+			writeVarint(bw, uint32(len(postings)))
+
+			var prevDoc uint32
+			for _, p := range postings {
+				writeVarint(bw, p.DocID-prevDoc)
+				prevDoc = p.DocID
+				writeVarint(bw, uint32(len(p.Offsets)))
+				var prevOff uint32
+				for _, off := range p.Offsets {
+					writeVarint(bw, off-prevOff)
+					prevOff = off
+				}
+			}
+		}
+
+		bw.Flush()
+		sf.Close()
+	}
+
+	mf, _ := os.Create(outDir + "/meta.json")
+	json.NewEncoder(mf).Encode(struct {
+		ShardCount int `json:"shardCount"`
+	}{ShardCount: ShardCount})
+	mf.Close()
+}
+
+func writeVarint(w io.Writer, v uint32) {
+	var buf [5]byte
+	n := binary.PutUvarint(buf[:], uint64(v))
+	w.Write(buf[:n])
+}
+
+// PostingsFor reads dir's shard for tri and returns the content-field
+// postings containing it. It reads only the one shard file the trigram
+// hashes to.
+func PostingsFor(dir string, tri [3]byte) []Posting {
+	return postingsFor(dir, tri, fieldContent)
+}
+
+func postingsFor(dir string, tri [3]byte, f field) []Posting {
+	shard := shardFor(tri)
+	sf, err := os.Open(fmt.Sprintf("%s/shard_%04d.bin", dir, shard))
+	if err != nil {
+		return nil
+	}
+	defer sf.Close()
+	br := bufio.NewReader(sf)
+
+	var out []Posting
+	for {
+		var key [3]byte
+		if _, err := io.ReadFull(br, key[:]); err != nil {
+			break
+		}
+		ftag, err := br.ReadByte()
+		if err != nil {
+			break
+		}
+		count := readVarint(br)
+		if key == tri && field(ftag) == f {
+			var docID uint32
+			for i := uint32(0); i < count; i++ {
+				delta := readVarint(br)
+				docID += delta
+				n := readVarint(br)
+				offsets := make([]uint32, n)
+				var prev uint32
+				for j := uint32(0); j < n; j++ {
+					prev += readVarint(br)
+					offsets[j] = prev
+				}
+				out = append(out, Posting{DocID: docID, Offsets: offsets})
+			}
+			return out
+		}
+		var docID uint32
+		for i := uint32(0); i < count; i++ {
+			docID += readVarint(br)
+			n := readVarint(br)
+			for j := uint32(0); j < n; j++ {
+				readVarint(br)
+			}
+		}
+	}
+	return out
+}
+
+func readVarint(r *bufio.Reader) uint32 {
+	v, _ := binary.ReadUvarint(r)
+	return uint32(v)
+}
+
+// CandidateDocs compiles re's required trigram expression and evaluates
+// it against the index to produce the documents that could possibly
+// match, leaving final verification (since trigrams are necessary but
+// not sufficient) to the caller. When re has no indexable literal
+// anywhere (e.g. every alternation branch is unconstrained, or its only
+// literal is shorter than a trigram) the expression can't rule anything
+// out, so every known document is returned rather than none.
+func CandidateDocs(dir string, re *syntax.Regexp) []uint32 {
+	ids, all := evalRequired(dir, requiredExpr(re.Simplify()))
+	if all {
+		return allDocIDs(dir)
+	}
+
+	out := make([]uint32, 0, len(ids))
+	for docID := range ids {
+		out = append(out, docID)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a] < out[b] })
+	return out
+}
+
+// exprOp is a required-trigram expression's node kind.
+type exprOp int
+
+const (
+	// exprAll matches every document; it carries no constraint, e.g. an
+	// alternation branch with no usable literal, or a literal shorter
+	// than a trigram.
+	exprAll exprOp = iota
+	// exprTrigram requires a single specific trigram to be present.
+	exprTrigram
+	// exprAnd requires every one of Subs to hold, e.g. the distinct
+	// trigrams of one literal run, or a concatenation of several runs.
+	exprAnd
+	// exprOr requires at least one of Subs to hold, e.g. an alternation.
+	exprOr
+)
+
+type reqExpr struct {
+	op  exprOp
+	tri [3]byte
+	sub []reqExpr
+}
+
+// requiredExpr derives the standard "necessary trigram expression" for
+// re: an AND/OR tree that must be satisfiable for re to match, built so
+// that evalRequired never has to treat "nothing indexable here" as
+// "nothing can match" (that conflation was the bug: OpAlternate was
+// dropped entirely, and so was any literal shorter than a trigram, both
+// of which silently emptied the candidate set instead of widening it).
+func requiredExpr(re *syntax.Regexp) reqExpr {
+	switch re.Op {
+	case syntax.OpLiteral:
+		s := strings.ToLower(string(re.Rune))
+		if len(s) < 3 {
+			return reqExpr{op: exprAll}
+		}
+		var subs []reqExpr
+		for i := 0; i+3 <= len(s); i++ {
+			var tri [3]byte
+			copy(tri[:], s[i:i+3])
+			subs = append(subs, reqExpr{op: exprTrigram, tri: tri})
+		}
+		return reqExpr{op: exprAnd, sub: subs}
+
+	case syntax.OpConcat:
+		var subs []reqExpr
+		for _, s := range re.Sub {
+			if e := requiredExpr(s); e.op != exprAll {
+				subs = append(subs, e)
+			}
+		}
+		if len(subs) == 0 {
+			return reqExpr{op: exprAll}
+		}
+		return reqExpr{op: exprAnd, sub: subs}
+
+	case syntax.OpAlternate:
+		subs := make([]reqExpr, len(re.Sub))
+		for i, s := range re.Sub {
+			subs[i] = requiredExpr(s)
+			if subs[i].op == exprAll {
+				// One branch needs nothing, so the alternation as a
+				// whole can be satisfied without any trigram appearing.
+				return reqExpr{op: exprAll}
+			}
+		}
+		return reqExpr{op: exprOr, sub: subs}
+
+	case syntax.OpCapture, syntax.OpPlus:
+		if len(re.Sub) == 1 {
+			return requiredExpr(re.Sub[0])
+		}
+	}
+	// Star, Quest, and anything else (Dot, CharClass, AnyChar, ...) may
+	// match without the subexpression appearing at all, so they impose
+	// no constraint.
+	return reqExpr{op: exprAll}
+}
+
+// evalRequired evaluates e against dir's index, returning the doc IDs
+// satisfying it. The second return reports whether e was unconstrained
+// (exprAll anywhere it wasn't eliminated by requiredExpr's simplification),
+// meaning the result is "every document", not "these documents".
+func evalRequired(dir string, e reqExpr) (ids map[uint32]bool, all bool) {
+	switch e.op {
+	case exprAll:
+		return nil, true
+
+	case exprTrigram:
+		set := make(map[uint32]bool)
+		for _, p := range postingsFor(dir, e.tri, fieldContent) {
+			set[p.DocID] = true
+		}
+		return set, false
+
+	case exprAnd:
+		var result map[uint32]bool
+		for _, sub := range e.sub {
+			subIDs, subAll := evalRequired(dir, sub)
+			if subAll {
+				continue
+			}
+			if result == nil {
+				result = subIDs
+				continue
+			}
+			for docID := range result {
+				if !subIDs[docID] {
+					delete(result, docID)
+				}
+			}
+		}
+		if result == nil {
+			return nil, true
+		}
+		return result, false
+
+	case exprOr:
+		result := make(map[uint32]bool)
+		for _, sub := range e.sub {
+			subIDs, subAll := evalRequired(dir, sub)
+			if subAll {
+				return nil, true
+			}
+			for docID := range subIDs {
+				result[docID] = true
+			}
+		}
+		return result, false
+	}
+	return nil, true
+}
+
+// allDocIDs scans every shard file and returns the full set of doc IDs
+// with any indexed content trigram — the fallback candidate universe
+// when a regex's required expression can't narrow anything down.
+func allDocIDs(dir string) []uint32 {
+	seen := make(map[uint32]bool)
+	for shard := 0; shard < ShardCount; shard++ {
+		sf, err := os.Open(fmt.Sprintf("%s/shard_%04d.bin", dir, shard))
+		if err != nil {
+			continue
+		}
+		br := bufio.NewReader(sf)
+		for {
+			var key [3]byte
+			if _, err := io.ReadFull(br, key[:]); err != nil {
+				break
+			}
+			ftag, err := br.ReadByte()
+			if err != nil {
+				break
+			}
+			count := readVarint(br)
+			var docID uint32
+			for i := uint32(0); i < count; i++ {
+				docID += readVarint(br)
+				if field(ftag) == fieldContent {
+					seen[docID] = true
+				}
+				n := readVarint(br)
+				for j := uint32(0); j < n; j++ {
+					readVarint(br)
+				}
+			}
+		}
+		sf.Close()
+	}
+	out := make([]uint32, 0, len(seen))
+	for docID := range seen {
+		out = append(out, docID)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a] < out[b] })
+	return out
+}
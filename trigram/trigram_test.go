@@ -0,0 +1,88 @@
+package trigram
+
+import (
+	"regexp/syntax"
+	"sort"
+	"testing"
+)
+
+func TestBuildPostingsForRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	docs := []Document{
+		{ID: 1, Title: "Berlin", Content: "Berlin is the capital of Germany."},
+		{ID: 2, Title: "Paris", Content: "Paris is the capital of France."},
+	}
+	Build(dir, docs)
+
+	var tri [3]byte
+	copy(tri[:], "cap") // "capital" appears in both docs
+	postings := PostingsFor(dir, tri)
+	if len(postings) != 2 {
+		t.Fatalf("PostingsFor(cap): got %d postings, want 2", len(postings))
+	}
+
+	copy(tri[:], "ber")
+	postings = PostingsFor(dir, tri)
+	if len(postings) != 1 || postings[0].DocID != 1 {
+		t.Fatalf("PostingsFor(ber): got %+v, want one posting for doc 1", postings)
+	}
+}
+
+func TestCandidateDocs(t *testing.T) {
+	dir := t.TempDir()
+	docs := []Document{
+		{ID: 1, Title: "Berlin", Content: "Berlin is the capital of Germany."},
+		{ID: 2, Title: "Paris", Content: "Paris is the capital of France."},
+		{ID: 3, Title: "Rome", Content: "Rome is the capital of Italy."},
+	}
+	Build(dir, docs)
+
+	re, err := syntax.Parse("germany", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := CandidateDocs(dir, re)
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(got) != 1 || got[0] != 1 {
+		t.Fatalf("CandidateDocs(germany): got %v, want [1]", got)
+	}
+}
+
+func TestCandidateDocsAlternation(t *testing.T) {
+	dir := t.TempDir()
+	docs := []Document{
+		{ID: 1, Title: "Cats", Content: "the cat sat on the mat."},
+		{ID: 2, Title: "Dogs", Content: "the dog ran in the yard."},
+		{ID: 3, Title: "Birds", Content: "the bird flew over the nest."},
+	}
+	Build(dir, docs)
+
+	re, err := syntax.Parse("cat|dog", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := CandidateDocs(dir, re)
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("CandidateDocs(cat|dog): got %v, want [1 2]", got)
+	}
+}
+
+func TestCandidateDocsShortLiteralFallsBackToFullScan(t *testing.T) {
+	dir := t.TempDir()
+	docs := []Document{
+		{ID: 1, Title: "A", Content: "ab cd"},
+		{ID: 2, Title: "B", Content: "ef gh"},
+	}
+	Build(dir, docs)
+
+	re, err := syntax.Parse("ab", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := CandidateDocs(dir, re)
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("CandidateDocs(ab): got %v, want [1 2] (can't index a 2-byte literal, so it must fall back to every doc)", got)
+	}
+}
@@ -0,0 +1,474 @@
+// Package wikitext tokenizes MediaWiki markup into a typed token stream
+// and renders that stream down to plain text. It replaces a dozen
+// standalone regexes (including a fixed-point loop for nested templates)
+// with a single hand-written scan, so constructs the regexes silently
+// mangled — nested templates, multi-line tables, verbatim blocks,
+// apostrophe runs, piped links — are handled explicitly instead.
+package wikitext
+
+import "strings"
+
+// TokenType identifies what kind of wikitext construct a Token came from.
+type TokenType int
+
+const (
+	Text TokenType = iota
+	Link
+	Template
+	TableCell
+	Heading
+	Quote
+	HTMLTag
+)
+
+// Token is one unit of the tokenized stream. Text is the token's already
+// resolved plain-text payload (e.g. a link's display text, a heading's
+// title); Level is only meaningful for Heading.
+type Token struct {
+	Type  TokenType
+	Text  string
+	Level int
+}
+
+// Tokenize scans s and returns its wikitext token stream.
+func Tokenize(s string) []Token {
+	r := []rune(s)
+	n := len(r)
+	var toks []Token
+	var text []rune
+
+	flush := func() {
+		if len(text) > 0 {
+			toks = append(toks, Token{Type: Text, Text: string(text)})
+			text = nil
+		}
+	}
+
+	atLineStart := func(i int) bool { return i == 0 || r[i-1] == '\n' }
+
+	i := 0
+	for i < n {
+		switch {
+		case hasPrefix(r, i, "<!--"):
+			j := indexFrom(r, i+4, "-->")
+			if j == -1 {
+				i = n
+			} else {
+				i = j + 3
+			}
+
+		case hasPrefixFold(r, i, "<nowiki>"):
+			flush()
+			j := indexFromFold(r, i+8, "</nowiki>")
+			end := j
+			if j == -1 {
+				end = n
+			}
+			toks = append(toks, Token{Type: Text, Text: string(r[i+8 : end])})
+			if j == -1 {
+				i = n
+			} else {
+				i = j + len("</nowiki>")
+			}
+
+		case hasPrefixFold(r, i, "<pre>"):
+			flush()
+			j := indexFromFold(r, i+5, "</pre>")
+			end := j
+			if j == -1 {
+				end = n
+			}
+			toks = append(toks, Token{Type: Text, Text: string(r[i+5 : end])})
+			if j == -1 {
+				i = n
+			} else {
+				i = j + len("</pre>")
+			}
+
+		case hasPrefixFold(r, i, "<ref"):
+			flush()
+			i = skipRef(r, i)
+
+		case r[i] == '<':
+			flush()
+			tok, next := parseHTMLTag(r, i)
+			toks = append(toks, tok)
+			i = next
+
+		case hasPrefix(r, i, "{{"):
+			flush()
+			tok, next := parseTemplate(r, i)
+			toks = append(toks, tok)
+			i = next
+
+		case hasPrefix(r, i, "{|"):
+			flush()
+			cells, next := parseTable(r, i)
+			toks = append(toks, cells...)
+			i = next
+
+		case hasPrefix(r, i, "[["):
+			flush()
+			tok, next := parseWikiLink(r, i)
+			if tok != nil {
+				toks = append(toks, *tok)
+			}
+			i = next
+
+		case r[i] == '[':
+			flush()
+			tok, next := parseExternalLink(r, i)
+			if tok != nil {
+				toks = append(toks, *tok)
+			}
+			i = next
+
+		case r[i] == '\'' && i+1 < n && r[i+1] == '\'':
+			flush()
+			tok, next := parseQuoteRun(r, i)
+			toks = append(toks, tok)
+			i = next
+
+		case r[i] == '=' && atLineStart(i):
+			flush()
+			tok, next := parseHeading(r, i)
+			toks = append(toks, tok)
+			i = next
+
+		default:
+			text = append(text, r[i])
+			i++
+		}
+	}
+	flush()
+	return toks
+}
+
+// Render collapses a token stream into the plain text fed to tokenize,
+// dropping markup tokens that carry no display text (templates, HTML
+// tags) and normalizing whitespace left behind by the strips.
+func Render(toks []Token) string {
+	var sb strings.Builder
+	for _, t := range toks {
+		switch t.Type {
+		case Text, Link, Quote:
+			sb.WriteString(t.Text)
+		case Heading:
+			sb.WriteString("\n")
+			sb.WriteString(t.Text)
+			sb.WriteString("\n")
+		case TableCell:
+			sb.WriteString(t.Text)
+			sb.WriteString(" ")
+		case Template, HTMLTag:
+			// carries no renderable text
+		}
+	}
+	return collapseWhitespace(sb.String())
+}
+
+func collapseWhitespace(s string) string {
+	var sb strings.Builder
+	var spaceRun, newlineRun int
+	for _, r := range s {
+		switch {
+		case r == ' ' || r == '\t':
+			spaceRun++
+			newlineRun = 0
+		case r == '\n':
+			newlineRun++
+			spaceRun = 0
+		default:
+			spaceRun, newlineRun = 0, 0
+		}
+		switch {
+		case spaceRun > 1:
+			continue
+		case newlineRun > 2:
+			continue
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// parseTemplate consumes a {{ ... }} span, tracking nesting depth so
+// {{templates{{inside}}}} consumes the whole construct in one pass
+// instead of the fixed-point regex loop this package replaces.
+func parseTemplate(r []rune, i int) (Token, int) {
+	depth := 0
+	for i < len(r) {
+		switch {
+		case hasPrefix(r, i, "{{"):
+			depth++
+			i += 2
+		case hasPrefix(r, i, "}}"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return Token{Type: Template}, i
+			}
+		default:
+			i++
+		}
+	}
+	return Token{Type: Template}, i
+}
+
+// parseTable consumes a {| ... |} block and emits one TableCell token
+// per cell, handling "|-" row separators and "!" header cells.
+func parseTable(r []rune, i int) ([]Token, int) {
+	end := indexFrom(r, i+2, "|}")
+	bodyEnd := end
+	next := len(r)
+	if end != -1 {
+		bodyEnd = end
+		next = end + 2
+	}
+	body := string(r[i+2 : bodyEnd])
+
+	var toks []Token
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "|-"), strings.HasPrefix(line, "{|"):
+			continue
+		case strings.HasPrefix(line, "!"):
+			for _, c := range strings.Split(line[1:], "!!") {
+				if t, ok := renderCell(c); ok {
+					toks = append(toks, t)
+				}
+			}
+		case strings.HasPrefix(line, "|"):
+			for _, c := range strings.Split(line[1:], "||") {
+				if t, ok := renderCell(c); ok {
+					toks = append(toks, t)
+				}
+			}
+		}
+	}
+	return toks, next
+}
+
+// renderCell strips a cell's attribute prefix (if any) and re-tokenizes
+// what's left with the same tokenizer used for the rest of the document,
+// so links, templates, and quote runs inside a cell resolve the same way
+// they would outside a table.
+func renderCell(cell string) (Token, bool) {
+	text := strings.TrimSpace(stripCellAttrs(cell))
+	if text == "" {
+		return Token{}, false
+	}
+	rendered := Render(Tokenize(text))
+	if rendered == "" {
+		return Token{}, false
+	}
+	return Token{Type: TableCell, Text: rendered}, true
+}
+
+// stripCellAttrs drops a cell's leading `attr="val"|` style prefix, if
+// present. Real cell attres always look like `key="value"` (or several,
+// space-separated) before the pipe, so a pipe only introduces attrs when
+// its prefix contains "=" and no wiki markup of its own; otherwise the
+// pipe belongs to markup inside the cell (a wikilink's display-text
+// separator as in `[[Berlin|Berlin]]`, or a template parameter as in
+// `{{flag|Germany}}`) and the cell has no attrs to strip.
+func stripCellAttrs(cell string) string {
+	pipeIdx := strings.Index(cell, "|")
+	if pipeIdx == -1 {
+		return cell
+	}
+	prefix := cell[:pipeIdx]
+	if !strings.Contains(prefix, "=") {
+		return cell
+	}
+	if strings.Contains(prefix, "[[") || strings.Contains(prefix, "{{") {
+		return cell
+	}
+	return cell[pipeIdx+1:]
+}
+
+// parseWikiLink consumes a [[ ... ]] span, tracking nesting depth so a
+// File:/Image: caption containing another [[link]] doesn't truncate the
+// match early. File:, Image:, and Category: namespaces are dropped
+// entirely, including their trailing bracketed options; anything else
+// keeps its piped display text (or the target when unpiped).
+func parseWikiLink(r []rune, i int) (*Token, int) {
+	start := i + 2
+	depth := 1
+	j := start
+	for j < len(r) && depth > 0 {
+		switch {
+		case hasPrefix(r, j, "[["):
+			depth++
+			j += 2
+		case hasPrefix(r, j, "]]"):
+			depth--
+			j += 2
+		default:
+			j++
+		}
+	}
+	inner := string(r[start:j])
+	inner = strings.TrimSuffix(inner, "]]")
+
+	lower := strings.ToLower(inner)
+	if strings.HasPrefix(lower, "file:") || strings.HasPrefix(lower, "image:") || strings.HasPrefix(lower, "category:") {
+		return nil, j
+	}
+
+	display := inner
+	if idx := strings.LastIndex(inner, "|"); idx != -1 {
+		display = inner[idx+1:]
+	}
+	return &Token{Type: Link, Text: display}, j
+}
+
+// parseExternalLink consumes a [url] or [url display text] span,
+// keeping the display text (if any) and dropping the URL.
+func parseExternalLink(r []rune, i int) (*Token, int) {
+	j := indexFromRune(r, i+1, ']')
+	if j == -1 {
+		return nil, len(r)
+	}
+	inner := string(r[i+1 : j])
+	next := j + 1
+	if sp := strings.IndexAny(inner, " \t"); sp != -1 {
+		display := strings.TrimSpace(inner[sp+1:])
+		if display != "" {
+			return &Token{Type: Link, Text: display}, next
+		}
+	}
+	return nil, next
+}
+
+// parseQuoteRun consumes a run of apostrophes and returns the literal
+// apostrophe text it leaves behind: 2 and 3-run toggles (italic, bold)
+// and the 5-run toggle (both) carry no literal text; a stray 4-run is
+// treated as a bold toggle plus one literal apostrophe, and runs beyond
+// 5 keep their extra apostrophes as literal text.
+func parseQuoteRun(r []rune, i int) (Token, int) {
+	start := i
+	for i < len(r) && r[i] == '\'' {
+		i++
+	}
+	n := i - start
+	switch {
+	case n == 4:
+		return Token{Type: Quote, Text: "'"}, i
+	case n > 5:
+		return Token{Type: Quote, Text: strings.Repeat("'", n-5)}, i
+	default:
+		return Token{Type: Quote}, i
+	}
+}
+
+// parseHeading consumes a line beginning with one or more '=' and
+// returns its title with the matching trailing '=' run (if any) removed.
+func parseHeading(r []rune, i int) (Token, int) {
+	start := i
+	for i < len(r) && r[i] == '=' {
+		i++
+	}
+	level := i - start
+
+	lineEnd := i
+	for lineEnd < len(r) && r[lineEnd] != '\n' {
+		lineEnd++
+	}
+	title := strings.TrimSpace(string(r[i:lineEnd]))
+	title = strings.TrimRight(title, "=")
+	title = strings.TrimSpace(title)
+	return Token{Type: Heading, Text: title, Level: level}, lineEnd
+}
+
+// skipRef consumes a <ref ...>...</ref> or self-closing <ref .../> span,
+// whose content is dropped the same way the regex it replaces dropped it.
+func skipRef(r []rune, i int) int {
+	j := i
+	for j < len(r) && r[j] != '>' {
+		j++
+	}
+	selfClosing := j > 0 && j <= len(r) && r[j-1] == '/'
+	if j < len(r) {
+		j++
+	}
+	if selfClosing {
+		return j
+	}
+	end := indexFromFold(r, j, "</ref>")
+	if end == -1 {
+		return len(r)
+	}
+	return end + len("</ref>")
+}
+
+// parseHTMLTag consumes a single <...> tag, dropping its markup but
+// leaving any enclosed content to be tokenized normally afterward.
+func parseHTMLTag(r []rune, i int) (Token, int) {
+	j := i
+	for j < len(r) && r[j] != '>' {
+		j++
+	}
+	if j < len(r) {
+		j++
+	}
+	return Token{Type: HTMLTag}, j
+}
+
+func hasPrefix(r []rune, i int, s string) bool {
+	for k, c := range s {
+		if i+k >= len(r) || r[i+k] != c {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPrefixFold(r []rune, i int, s string) bool {
+	for k, c := range strings.ToLower(s) {
+		if i+k >= len(r) || toLowerRune(r[i+k]) != c {
+			return false
+		}
+	}
+	return true
+}
+
+func toLowerRune(r rune) rune {
+	if r >= 'A' && r <= 'Z' {
+		return r + ('a' - 'A')
+	}
+	return r
+}
+
+func indexFrom(r []rune, from int, sub string) int {
+	if from > len(r) {
+		return -1
+	}
+	idx := strings.Index(string(r[from:]), sub)
+	if idx == -1 {
+		return -1
+	}
+	return from + idx
+}
+
+func indexFromFold(r []rune, from int, sub string) int {
+	if from > len(r) {
+		return -1
+	}
+	idx := strings.Index(strings.ToLower(string(r[from:])), strings.ToLower(sub))
+	if idx == -1 {
+		return -1
+	}
+	return from + idx
+}
+
+func indexFromRune(r []rune, from int, c rune) int {
+	for i := from; i < len(r); i++ {
+		if r[i] == c {
+			return i
+		}
+	}
+	return -1
+}
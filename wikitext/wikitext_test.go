@@ -0,0 +1,30 @@
+package wikitext
+
+import "testing"
+
+func TestTableCellResolvesWikilinks(t *testing.T) {
+	s := "{|\n| [[Berlin|Berlin]] || 3,769,495\n|}"
+	got := Render(Tokenize(s))
+	want := "Berlin 3,769,495"
+	if got != want {
+		t.Fatalf("Render(Tokenize(%q)) = %q, want %q", s, got, want)
+	}
+}
+
+func TestTableCellAttrsStillStripped(t *testing.T) {
+	s := "{|\n! style=\"text-align:left\"|City\n| align=\"right\"|3,769,495\n|}"
+	got := Render(Tokenize(s))
+	want := "City 3,769,495"
+	if got != want {
+		t.Fatalf("Render(Tokenize(%q)) = %q, want %q", s, got, want)
+	}
+}
+
+func TestTableCellResolvesTemplatesAndQuotes(t *testing.T) {
+	s := "{|\n| '''Berlin''' {{flag|Germany}}\n|}"
+	got := Render(Tokenize(s))
+	want := "Berlin"
+	if got != want {
+		t.Fatalf("Render(Tokenize(%q)) = %q, want %q", s, got, want)
+	}
+}